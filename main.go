@@ -20,6 +20,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"runtime"
 
@@ -30,12 +31,28 @@ import (
 
 var debug bool
 var cfgFile string
+var genKey bool
+var unblock bool
 
 func main() {
 	flag.BoolVar(&debug, "debug", false, "Provide debug info")
 	flag.StringVar(&cfgFile, "config", "", "configfile")
+	flag.BoolVar(&genKey, "genkey", false, "Print a new key pair for payload encryption")
+	flag.BoolVar(&unblock, "unblock", false, "Remove kill switch rules and DNS settings left by the client")
 	flag.Parse()
 
+	if genKey {
+		private, public, err := server.GenerateKey()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("privateKey =", private)
+		fmt.Println("serverKey =", public)
+		fmt.Println("# for a client key, set the public key as key of its [identity] section")
+		return
+	}
+
 	InitLogger(debug)
 	logger := GetLogger()
 
@@ -46,6 +63,12 @@ func main() {
 		}
 	}
 
+	if unblock {
+		checkerr(client.RestoreDns())
+		checkerr(client.RemoveKillSwitch())
+		return
+	}
+
 	if cfgFile == "" {
 		cfgFile = flag.Arg(0)
 	}
@@ -0,0 +1,287 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	. "github.com/zreigz/ws-vpn/vpn/utils"
+)
+
+const (
+	ACL_ALLOW = iota
+	ACL_DENY
+	ACL_LOG
+)
+
+const (
+	DIR_BOTH = iota
+	// from client to server
+	DIR_UP
+	// from server to client
+	DIR_DOWN
+)
+
+var invalidRule = errors.New("Invalid packet filter rule")
+
+// fields of an IPv4 packet used by the packet filter
+type packetInfo struct {
+	src     net.IP
+	dst     net.IP
+	proto   int
+	srcPort int
+	dstPort int
+}
+
+// parse IPv4 header and TCP/UDP ports, ok is false for anything else
+func parsePacket(p []byte) (info packetInfo, ok bool) {
+	if len(p) < 20 || p[0]>>4 != 4 {
+		return info, false
+	}
+	hlen := int(p[0]&0x0f) * 4
+	if hlen < 20 || len(p) < hlen {
+		return info, false
+	}
+	info.proto = int(p[9])
+	info.src = net.IP(p[12:16])
+	info.dst = net.IP(p[16:20])
+
+	// ports are only in the first fragment
+	fragOffset := binary.BigEndian.Uint16(p[6:8]) & 0x1fff
+	if (info.proto == 6 || info.proto == 17) && fragOffset == 0 && len(p) >= hlen+4 {
+		info.srcPort = int(binary.BigEndian.Uint16(p[hlen : hlen+2]))
+		info.dstPort = int(binary.BigEndian.Uint16(p[hlen+2 : hlen+4]))
+	}
+	return info, true
+}
+
+// hash of addresses, protocol and ports, keeps a flow on one queue or link
+func flowHash(p []byte) uint32 {
+	info, ok := parsePacket(p)
+	if !ok {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write(info.src)
+	h.Write(info.dst)
+	h.Write([]byte{byte(info.proto), byte(info.srcPort >> 8), byte(info.srcPort),
+		byte(info.dstPort >> 8), byte(info.dstPort)})
+	return h.Sum32()
+}
+
+type aclRule struct {
+	// counters first, keeps them 64-bit aligned for atomic access
+	packets uint64
+	bytes   uint64
+
+	name      string
+	priority  int
+	action    int
+	src       []*net.IPNet
+	dst       []*net.IPNet
+	proto     int
+	portLo    int
+	portHi    int
+	identity  string
+	group     string
+	direction int
+}
+
+type acl struct {
+	rules []*aclRule
+	deny  bool
+}
+
+func newAcl(cfg ServerConfig) (*acl, error) {
+	a := new(acl)
+	switch cfg.AclDefault {
+	case "", "allow":
+	case "deny":
+		a.deny = true
+	default:
+		return nil, fmt.Errorf("%v: aclDefault %s", invalidRule, cfg.AclDefault)
+	}
+
+	for name, rc := range cfg.Rule {
+		rule, err := newAclRule(name, rc)
+		if err != nil {
+			return nil, fmt.Errorf("%v %s: %v", invalidRule, name, err)
+		}
+		a.rules = append(a.rules, rule)
+	}
+	sort.Slice(a.rules, func(i, j int) bool {
+		if a.rules[i].priority != a.rules[j].priority {
+			return a.rules[i].priority < a.rules[j].priority
+		}
+		return a.rules[i].name < a.rules[j].name
+	})
+	return a, nil
+}
+
+func newAclRule(name string, rc *RuleConfig) (*aclRule, error) {
+	var err error
+	rule := &aclRule{name: name, priority: rc.Priority, proto: -1, identity: rc.Identity, group: rc.Group}
+
+	switch rc.Action {
+	case "allow":
+		rule.action = ACL_ALLOW
+	case "deny":
+		rule.action = ACL_DENY
+	case "log":
+		rule.action = ACL_LOG
+	default:
+		return nil, fmt.Errorf("action %q", rc.Action)
+	}
+
+	switch rc.Direction {
+	case "", "both":
+		rule.direction = DIR_BOTH
+	case "up":
+		rule.direction = DIR_UP
+	case "down":
+		rule.direction = DIR_DOWN
+	default:
+		return nil, fmt.Errorf("direction %q", rc.Direction)
+	}
+
+	if rule.src, err = parseCIDRs(rc.Src); err != nil {
+		return nil, err
+	}
+	if rule.dst, err = parseCIDRs(rc.Dst); err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(rc.Proto) {
+	case "", "any":
+	case "icmp":
+		rule.proto = 1
+	case "tcp":
+		rule.proto = 6
+	case "udp":
+		rule.proto = 17
+	default:
+		if rule.proto, err = strconv.Atoi(rc.Proto); err != nil {
+			return nil, fmt.Errorf("proto %q", rc.Proto)
+		}
+	}
+
+	if rc.Port != "" {
+		ports := strings.SplitN(rc.Port, "-", 2)
+		if rule.portLo, err = strconv.Atoi(ports[0]); err != nil {
+			return nil, fmt.Errorf("port %q", rc.Port)
+		}
+		rule.portHi = rule.portLo
+		if len(ports) == 2 {
+			if rule.portHi, err = strconv.Atoi(ports[1]); err != nil {
+				return nil, fmt.Errorf("port %q", rc.Port)
+			}
+		}
+	}
+	return rule, nil
+}
+
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, entry := range list {
+		if !strings.Contains(entry, "/") {
+			entry += "/32"
+		}
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func matchCIDRs(nets []*net.IPNet, ip net.IP) bool {
+	if len(nets) == 0 {
+		return true
+	}
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *aclRule) match(info *packetInfo, c *connection, dir int) bool {
+	if r.direction != DIR_BOTH && r.direction != dir {
+		return false
+	}
+	// names are chosen by clients, only proven ones match
+	if r.identity != "" && (!c.authenticated || r.identity != c.identity) {
+		return false
+	}
+	if r.group != "" && (!c.authenticated || r.group != c.group) {
+		return false
+	}
+	if r.proto != -1 && r.proto != info.proto {
+		return false
+	}
+	if r.portLo != 0 && (info.dstPort < r.portLo || info.dstPort > r.portHi) {
+		return false
+	}
+	return matchCIDRs(r.src, info.src) && matchCIDRs(r.dst, info.dst)
+}
+
+// check packet sent from (DIR_UP) or to (DIR_DOWN) the client connection
+func (a *acl) allowed(p []byte, c *connection, dir int) bool {
+	if len(a.rules) == 0 {
+		return !a.deny
+	}
+	info, ok := parsePacket(p)
+	if !ok {
+		return !a.deny
+	}
+	for _, rule := range a.rules {
+		if !rule.match(&info, c, dir) {
+			continue
+		}
+		atomic.AddUint64(&rule.packets, 1)
+		atomic.AddUint64(&rule.bytes, uint64(len(p)))
+		switch rule.action {
+		case ACL_LOG:
+			logger.Info("Rule", rule.name, "matched:", c.ipAddress.IP, info.src, info.srcPort, "->", info.dst, info.dstPort, "proto", info.proto)
+		case ACL_ALLOW:
+			return true
+		case ACL_DENY:
+			logger.Debug("Rule", rule.name, "drops packet", info.src, "->", info.dst)
+			return false
+		}
+	}
+	return !a.deny
+}
+
+// log counters of every rule
+func (a *acl) dump() {
+	for _, rule := range a.rules {
+		logger.Info(fmt.Sprintf("Rule %s: %d packets, %d bytes",
+			rule.name, atomic.LoadUint64(&rule.packets), atomic.LoadUint64(&rule.bytes)))
+	}
+}
@@ -0,0 +1,159 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"net"
+	"testing"
+
+	. "github.com/zreigz/ws-vpn/vpn/utils"
+)
+
+// IPv4 header with TCP or UDP ports
+func testPacket(src, dst string, proto, srcPort, dstPort int) []byte {
+	p := make([]byte, 40)
+	p[0] = 0x45
+	p[9] = byte(proto)
+	copy(p[12:16], net.ParseIP(src).To4())
+	copy(p[16:20], net.ParseIP(dst).To4())
+	p[20], p[21] = byte(srcPort>>8), byte(srcPort)
+	p[22], p[23] = byte(dstPort>>8), byte(dstPort)
+	return p
+}
+
+func TestParsePacket(t *testing.T) {
+	p := testPacket("10.1.1.3", "10.1.1.5", 6, 4711, 22)
+	info, ok := parsePacket(p)
+	if !ok || !info.src.Equal(net.ParseIP("10.1.1.3")) || !info.dst.Equal(net.ParseIP("10.1.1.5")) ||
+		info.proto != 6 || info.srcPort != 4711 || info.dstPort != 22 {
+		t.Errorf("parsePacket = %+v, %v", info, ok)
+	}
+
+	fragment := testPacket("10.1.1.3", "10.1.1.5", 17, 53, 53)
+	fragment[7] = 1
+	if info, _ := parsePacket(fragment); info.dstPort != 0 {
+		t.Errorf("ports read from a later fragment: %d", info.dstPort)
+	}
+
+	for name, p := range map[string][]byte{
+		"short":    p[:19],
+		"ipv6":     append([]byte{0x60}, p[1:]...),
+		"bad hlen": append([]byte{0x4f}, p[1:]...),
+	} {
+		if _, ok := parsePacket(p); ok {
+			t.Errorf("%s packet parsed", name)
+		}
+	}
+}
+
+func TestNewAclErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  ServerConfig
+	}{
+		{"default", ServerConfig{AclDefault: "maybe"}},
+		{"action", ServerConfig{Rule: map[string]*RuleConfig{"r": {Action: "drop"}}}},
+		{"direction", ServerConfig{Rule: map[string]*RuleConfig{"r": {Action: "deny", Direction: "left"}}}},
+		{"cidr", ServerConfig{Rule: map[string]*RuleConfig{"r": {Action: "deny", Dst: []string{"10.1.1/24"}}}}},
+		{"proto", ServerConfig{Rule: map[string]*RuleConfig{"r": {Action: "deny", Proto: "sctp"}}}},
+		{"port", ServerConfig{Rule: map[string]*RuleConfig{"r": {Action: "deny", Port: "22-x"}}}},
+	}
+	for _, tt := range tests {
+		if _, err := newAcl(tt.cfg); err == nil {
+			t.Errorf("%s: invalid config accepted", tt.name)
+		}
+	}
+}
+
+func TestAclAllowed(t *testing.T) {
+	cfg := ServerConfig{Rule: map[string]*RuleConfig{
+		"ssh": {Priority: 10, Action: "deny", Dst: []string{"10.1.1.0/24"}, Proto: "tcp", Port: "22", Group: "guests"},
+		"web": {Priority: 20, Action: "deny", Proto: "tcp", Port: "8000-8080", Direction: "down"},
+		"bob": {Priority: 30, Action: "deny", Identity: "bob"},
+		"dns": {Priority: 5, Action: "allow", Proto: "udp", Port: "53"},
+	}}
+	a, err := newAcl(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guest := &connection{identity: "eve", group: "guests", authenticated: true}
+	dev := &connection{identity: "alice", group: "devs", authenticated: true}
+	bob := &connection{identity: "bob", authenticated: true}
+	claimed := &connection{identity: "eve", group: "guests"}
+
+	tests := []struct {
+		name string
+		p    []byte
+		c    *connection
+		dir  int
+		want bool
+	}{
+		{"guest ssh", testPacket("10.1.1.3", "10.1.1.5", 6, 4711, 22), guest, DIR_UP, false},
+		{"dev ssh", testPacket("10.1.1.3", "10.1.1.5", 6, 4711, 22), dev, DIR_UP, true},
+		{"guest ssh outside subnet", testPacket("10.1.1.3", "192.0.2.1", 6, 4711, 22), guest, DIR_UP, true},
+		{"guest udp 22", testPacket("10.1.1.3", "10.1.1.5", 17, 4711, 22), guest, DIR_UP, true},
+		{"port range down", testPacket("10.1.1.5", "10.1.1.3", 6, 4711, 8080), dev, DIR_DOWN, false},
+		{"port range up", testPacket("10.1.1.3", "10.1.1.5", 6, 4711, 8080), dev, DIR_UP, true},
+		{"port above range", testPacket("10.1.1.5", "10.1.1.3", 6, 4711, 8081), dev, DIR_DOWN, true},
+		{"identity", testPacket("10.1.1.3", "10.1.1.5", 1, 0, 0), bob, DIR_UP, false},
+		{"unauthenticated group", testPacket("10.1.1.3", "10.1.1.5", 6, 4711, 22), claimed, DIR_UP, true},
+		{"lower priority wins", testPacket("10.1.1.3", "10.1.1.1", 17, 4711, 53), bob, DIR_UP, true},
+		{"not ipv4", []byte{0x60, 0, 0, 0}, bob, DIR_UP, true},
+	}
+	for _, tt := range tests {
+		if got := a.allowed(tt.p, tt.c, tt.dir); got != tt.want {
+			t.Errorf("%s: allowed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAclDefaultDeny(t *testing.T) {
+	a, err := newAcl(ServerConfig{AclDefault: "deny", Rule: map[string]*RuleConfig{
+		"icmp": {Action: "allow", Proto: "icmp"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &connection{}
+	if !a.allowed(testPacket("10.1.1.3", "10.1.1.5", 1, 0, 0), c, DIR_UP) {
+		t.Error("allowed packet dropped")
+	}
+	if a.allowed(testPacket("10.1.1.3", "10.1.1.5", 6, 1, 80), c, DIR_UP) {
+		t.Error("unmatched packet passed with default deny")
+	}
+}
+
+func TestAclIdentityNeedsKey(t *testing.T) {
+	a, err := newAcl(ServerConfig{AclDefault: "deny", Rule: map[string]*RuleConfig{
+		"admin": {Action: "allow", Identity: "admin"},
+		"ops":   {Action: "allow", Group: "ops"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := testPacket("10.1.1.3", "10.1.1.5", 6, 1, 80)
+	for _, c := range []*connection{{identity: "admin"}, {identity: "x", group: "ops"}} {
+		if a.allowed(p, c, DIR_UP) {
+			t.Errorf("claimed name %q group %q allowed", c.identity, c.group)
+		}
+		c.authenticated = true
+		if !a.allowed(p, c, DIR_UP) {
+			t.Errorf("authenticated name %q group %q dropped", c.identity, c.group)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// maximum size of a frame with batched packets
+const BATCH_SIZE = 32 * 1024
+
+var invalidBatch = errors.New("Invalid batch frame")
+
+// Coalesces packets into one websocket frame. The frame is a sequence of
+// packets, each prefixed with its length as big-endian uint16. Batched
+// frames are sent as binary messages, single packets stay text messages.
+type batcher struct {
+	buf   []byte
+	delay time.Duration
+
+	packets uint64
+	frames  uint64
+}
+
+func newBatcher(delay time.Duration) *batcher {
+	return &batcher{buf: make([]byte, 0, BATCH_SIZE), delay: delay}
+}
+
+func (b *batcher) add(p []byte) bool {
+	if len(b.buf)+2+len(p) > cap(b.buf) {
+		return false
+	}
+	b.buf = append(b.buf, byte(len(p)>>8), byte(len(p)))
+	b.buf = append(b.buf, p...)
+	atomic.AddUint64(&b.packets, 1)
+	return true
+}
+
+// Collect first packet and packets waiting in queue into a frame. Without
+// delay only packets already queued are taken, otherwise it waits up to
+// delay for more. Returns the frame and a message which has to be written
+// after it, either not a packet or a packet which didn't fit.
+func (b *batcher) collect(first *Data, queue <-chan *Data) (frame []byte, next *Data) {
+	b.buf = b.buf[:0]
+	b.add(first.Payload)
+	first.release()
+
+	var deadline <-chan time.Time
+	if b.delay > 0 {
+		timer := time.NewTimer(b.delay)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		var message *Data
+		var ok bool
+		if deadline == nil {
+			select {
+			case message, ok = <-queue:
+			default:
+				return b.frame(), nil
+			}
+		} else {
+			select {
+			case message, ok = <-queue:
+			case <-deadline:
+				return b.frame(), nil
+			}
+		}
+		if !ok || message == nil {
+			return b.frame(), nil
+		}
+		if message.ConnectionState != STATE_CONNECTED || !b.add(message.Payload) {
+			return b.frame(), message
+		}
+		message.release()
+	}
+}
+
+func (b *batcher) frame() []byte {
+	atomic.AddUint64(&b.frames, 1)
+	return b.buf
+}
+
+// packets per frame achieved so far
+func (b *batcher) ratio() float64 {
+	frames := atomic.LoadUint64(&b.frames)
+	if frames == 0 {
+		return 0
+	}
+	return float64(atomic.LoadUint64(&b.packets)) / float64(frames)
+}
+
+// split frame and hand every packet in a pooled record to fn
+func unbatch(frame []byte, fn func(d *Data)) error {
+	for len(frame) > 0 {
+		if len(frame) < 2 {
+			return invalidBatch
+		}
+		n := int(binary.BigEndian.Uint16(frame))
+		frame = frame[2:]
+		if n > len(frame) || n > IFACE_BUFSIZE {
+			return invalidBatch
+		}
+		d := newPacket()
+		d.Payload = d.buf[:copy(d.buf, frame[:n])]
+		frame = frame[n:]
+		fn(d)
+	}
+	return nil
+}
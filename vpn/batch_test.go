@@ -0,0 +1,172 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestBatchRoundTrip(t *testing.T) {
+	packets := [][]byte{
+		bytes.Repeat([]byte{1}, 60),
+		{},
+		bytes.Repeat([]byte{2}, IFACE_BUFSIZE),
+		bytes.Repeat([]byte{3}, 1400),
+	}
+	b := newBatcher(0)
+	for _, p := range packets {
+		if !b.add(p) {
+			t.Fatalf("packet of %d bytes didn't fit", len(p))
+		}
+	}
+	var got [][]byte
+	err := unbatch(b.frame(), func(d *Data) {
+		got = append(got, append([]byte{}, d.Payload...))
+		d.release()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(packets) {
+		t.Fatalf("got %d packets, want %d", len(got), len(packets))
+	}
+	for i := range packets {
+		if !bytes.Equal(got[i], packets[i]) {
+			t.Errorf("packet %d: got %d bytes, want %d", i, len(got[i]), len(packets[i]))
+		}
+	}
+}
+
+func TestBatchFull(t *testing.T) {
+	b := newBatcher(0)
+	p := make([]byte, 1000)
+	n := 0
+	for b.add(p) {
+		n++
+	}
+	if want := BATCH_SIZE / (len(p) + 2); n != want {
+		t.Errorf("%d packets fit into a frame, want %d", n, want)
+	}
+}
+
+func TestUnbatchInvalid(t *testing.T) {
+	prefix := func(n int) []byte {
+		b := make([]byte, 2)
+		binary.BigEndian.PutUint16(b, uint16(n))
+		return b
+	}
+	valid := append(prefix(3), 1, 2, 3)
+
+	tests := []struct {
+		name  string
+		frame []byte
+		// packets handed out before the error
+		packets int
+	}{
+		{"half prefix", []byte{0}, 0},
+		{"truncated packet", append(prefix(10), 1, 2, 3), 0},
+		{"truncated after packet", append(append([]byte{}, valid...), prefix(4)...), 1},
+		{"dangling byte", append(append([]byte{}, valid...), 0), 1},
+		{"oversized prefix", append(prefix(IFACE_BUFSIZE+1), make([]byte, IFACE_BUFSIZE+1)...), 0},
+		{"prefix beyond frame", append(prefix(0xffff), 1), 0},
+	}
+	for _, tt := range tests {
+		n := 0
+		err := unbatch(tt.frame, func(d *Data) {
+			n++
+			d.release()
+		})
+		if err != invalidBatch {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, invalidBatch)
+		}
+		if n != tt.packets {
+			t.Errorf("%s: %d packets before the error, want %d", tt.name, n, tt.packets)
+		}
+	}
+}
+
+// throughput of packets sent through a link, one frame per packet or
+// batched frames of the packets waiting in the queue
+func BenchmarkBatch(b *testing.B) {
+	for _, size := range []int{64, 1400} {
+		for _, batched := range []bool{false, true} {
+			mode := "single"
+			if batched {
+				mode = "batched"
+			}
+			b.Run(fmt.Sprintf("%s/%d", mode, size), func(b *testing.B) {
+				benchmarkBatch(b, size, batched)
+			})
+		}
+	}
+}
+
+func benchmarkBatch(b *testing.B, size int, batched bool) {
+	client, server := wsPair(b)
+	l := newLink(server, nil, nil)
+	if batched {
+		l.batcher = newBatcher(0)
+	}
+	packet := bytes.Repeat([]byte{0x45}, size)
+
+	frames := 0
+	done := make(chan error, 1)
+	go func(n int) {
+		for received := 0; received < n; frames++ {
+			messageType, d, err := readPacket(client)
+			if err != nil {
+				done <- err
+				return
+			}
+			if messageType == websocket.BinaryMessage {
+				err = unbatch(d.Payload, func(p *Data) {
+					received++
+					p.release()
+				})
+			} else {
+				received++
+			}
+			d.release()
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}(b.N)
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	go l.writePump()
+	for i := 0; i < b.N; i++ {
+		d := newPacket()
+		d.Payload = d.buf[:copy(d.buf, packet)]
+		l.data <- d
+	}
+	if err := <-done; err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+	close(l.data)
+	b.ReportMetric(float64(b.N)/float64(frames), "packets/frame")
+}
@@ -18,12 +18,14 @@
 package vpn
 
 import (
+	"context"
 	"errors"
-	"github.com/songgao/water"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 
 	. "github.com/zreigz/ws-vpn/vpn/utils"
-	"net/url"
 	"os"
 	"os/signal"
 	"syscall"
@@ -33,167 +35,883 @@ import (
 
 	"time"
 
-	"fmt"
 )
 
 type Client struct {
 	// config
 	cfg ClientConfig
+	// callbacks of an embedded client
+	opts ClientOptions
 	// interface
-	iface *water.Interface
+	iface device
+	// userspace stack, nil when using a tun device
+	netstack *netstackDevice
+	// local proxies and forwards of the userspace stack
+	listeners []io.Closer
 	// ip addr
-	ip net.IP
+	ip     net.IP
+	subnet *net.IPNet
+	// up script ran for the address
+	up bool
+	// firewall blocking traffic outside the tunnel, nil when disabled
+	killSwitch *killSwitch
+	// resolver settings of the tunnel, nil when not changed
+	dns *dnsConfig
+	// peer address of the tun interface
+	peer net.IP
+	mtu  int
+	// default route and nic used for the route to the server
+	gateway, nic string
+	// keepalive of the websockets
+	pingInterval, pingTimeout time.Duration
+
+	toIface chan *Data
+
+	// websockets carrying the session
+	links   []*link
+	linksMu sync.RWMutex
+	// websocket waiting for the handshake reply, it carries packets only
+	// once the keys of the new session are set
+	pending *link
+	// closed when the client stops
+	done      chan struct{}
+	closeOnce sync.Once
+	// error which stopped the client
+	err error
+	// first error of the cleanup
+	closeErr error
+	// set when stop started, lost links don't reconnect
+	stopping int32
+
+	// servers in the order of the config and the one in use
+	endpoints []endpoint
+	endpoint  endpoint
+	// endpoint routes outside the tunnel
+	bypassed []string
+	// server url and path
+	url  string
+	path string
+	// session token from the handshake
+	session string
+	// dials websockets, offers compression when enabled
+	dialer   websocket.Dialer
+	compress bool
+	// payload encryption, nil when not used
+	sealer *sealer
+	// pinned server key and our ephemeral key for the key exchange
+	serverKey []byte
+	// static key proving our name, nil when not set
+	identity  *keyPair
+	ephemeral *keyPair
+	hello     *Handshake
+
+	state *stateMachine
+
+	// routes deleted on cleanup, changed by reconnects while stopping
+	routesMu sync.Mutex
+	routes   []string
+}
 
-	toIface chan []byte
+// ClientOptions configures a client embedded in another program, the
+// callbacks are optional
+type ClientOptions struct {
+	Config ClientConfig
+	// session established, called with the assigned address
+	OnConnect func(ip *net.IPNet)
+	// client stopped, err is nil after Close
+	OnDisconnect func(err error)
+}
 
-	ws *websocket.Conn
+var errDisconnected = errors.New("Disconnected from server")
 
-	data chan *Data
+var errIdentityServerKey = errors.New("privateKey needs serverKey")
 
-	state int
+var errNoEndpoint = errors.New("No server endpoint reachable")
 
-	routes []string
-}
-
-var net_gateway, net_nic string
+var errKillSwitchUserspace = errors.New("Kill switch needs a tun device, not userspace mode")
 
+// NewClient runs a client with the config until SIGINT or SIGTERM or until
+// the connection to the server is lost.
 func NewClient(cfg ClientConfig) error {
-	var err error
+	client, err := NewClientWithOptions(ClientOptions{Config: cfg})
+	if err != nil {
+		return err
+	}
+	if err := client.Start(context.Background()); err != nil {
+		return err
+	}
 
-	if cfg.MTU != 0 {
-		MTU = cfg.MTU
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(c)
+	select {
+	case <-c:
+		logger.Info("Cleaning Up")
+		return client.Close()
+	case <-client.Done():
+		return client.Err()
 	}
+}
+
+// NewClientWithOptions checks the configuration and returns a client which
+// is not connected yet, see Start.
+func NewClientWithOptions(opts ClientOptions) (*Client, error) {
+	var err error
+	cfg := opts.Config
 
 	client := new(Client)
 	client.cfg = cfg
+	client.opts = opts
+	client.mtu = cfg.MTU
+	if client.mtu == 0 {
+		client.mtu = DEFAULT_MTU
+	}
+
+	client.pingInterval, client.pingTimeout, err = keepaliveConfig(cfg.PingInterval, cfg.PingTimeout)
+	if err != nil {
+		return nil, err
+	}
 
-	client.toIface = make(chan []byte, 100)
-	client.data = make(chan *Data, 100)
+	client.toIface = make(chan *Data, 100)
 	client.routes = make([]string, 0, 1024)
+	client.done = make(chan struct{})
+	client.state = newStateMachine(StateConnecting)
 
-	go client.cleanUp()
+	for _, entry := range cfg.Forward {
+		if _, _, err := parseForward(entry); err != nil {
+			return nil, err
+		}
+	}
+	if err := parseDns(cfg.Dns); err != nil {
+		return nil, err
+	}
+	if cfg.KillSwitch && (cfg.Userspace || len(cfg.Forward) > 0) {
+		return nil, errKillSwitchUserspace
+	}
 
-	iface, err := newTun("")
+	client.compress, err = compressionEnabled(cfg.Compression)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	client.iface = iface
+	if client.compress && cfg.ServerKey != "" {
+		// sealed packets don't compress, and compressing before sealing
+		// would leak their contents through the frame lengths
+		logger.Info("Compression is disabled when encryption is used")
+		client.compress = false
+	}
+	client.dialer = *websocket.DefaultDialer
+	client.dialer.EnableCompression = client.compress
 
-	net_gateway, net_nic, err = getNetGateway()
-	logger.Debug("Net Gateway: ", net_gateway, net_nic)
-	if err != nil {
-		logger.Error("Net gateway error")
-		return err
+	client.hello = &Handshake{Name: cfg.Name, Batch: cfg.Batch}
+	if cfg.ServerKey != "" {
+		if client.serverKey, err = decodeKey(cfg.ServerKey); err != nil {
+			return nil, err
+		}
+		if client.ephemeral, err = newKeyPair(nil); err != nil {
+			return nil, err
+		}
+		client.hello.Key = client.ephemeral.public
+	}
+	if cfg.PrivateKey != "" {
+		if client.serverKey == nil {
+			return nil, errIdentityServerKey
+		}
+		private, err := decodeKey(cfg.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		if client.identity, err = newKeyPair(private); err != nil {
+			return nil, err
+		}
 	}
-	srvDest := cfg.Server + "/32"
-	addRoute(srvDest, net_gateway, net_nic)
-	client.routes = append(client.routes, srvDest)
 
-	srvAdr := fmt.Sprintf("%s:%d", cfg.Server, cfg.Port)
-	u := url.URL{Scheme: "ws", Host: srvAdr, Path: "/ws"}
-	logger.Debug("Connecting to ", u.String())
+	client.path = cfg.Path
+	if client.path == "" {
+		client.path = WS_PATH
+	}
+	if cfg.Server != "" {
+		client.endpoints = append(client.endpoints, endpoint{host: cfg.Server, port: cfg.Port})
+	}
+	for _, entry := range cfg.Endpoint {
+		e, err := parseEndpoint(entry)
+		if err != nil {
+			return nil, err
+		}
+		client.endpoints = append(client.endpoints, e)
+	}
+	if len(client.endpoints) == 0 {
+		return nil, errNoEndpoint
+	}
+	client.endpoint = client.endpoints[0]
+	client.url = client.endpoint.url(client.path)
+
+	return client, nil
+}
+
+// Start creates the interface and connects to the server in background.
+// The client runs until the context is canceled, Close is called or the
+// connection is lost.
+func (clt *Client) Start(ctx context.Context) error {
+	var err error
+	cfg := clt.cfg
+
+	// forwards don't need a tun device or routes
+	if cfg.Userspace || len(cfg.Forward) > 0 {
+		clt.netstack, err = newNetstack(clt.mtu)
+		if err != nil {
+			return err
+		}
+		clt.iface = clt.netstack
+	} else {
+		iface, err := newTun("", clt.mtu)
+		if err != nil {
+			return err
+		}
+		clt.iface = iface
+
+		clt.gateway, clt.nic, err = getNetGateway()
+		logger.Debug("Net Gateway: ", clt.gateway, clt.nic)
+		if err != nil {
+			logger.Error("Net gateway error")
+			iface.Close()
+			return err
+		}
+		if cfg.KillSwitch {
+			servers := make([]string, len(clt.endpoints))
+			for i, e := range clt.endpoints {
+				servers[i] = e.addr()
+			}
+			clt.killSwitch, err = setupKillSwitch(iface.Name(), servers)
+			if err != nil {
+				iface.Close()
+				return err
+			}
+		}
+	}
 
+	go clt.connect()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			clt.Close()
+		case <-clt.done:
+		}
+	}()
+
+	return nil
+}
+
+// dial the server until it answers and send the handshake
+func (clt *Client) connect() {
+	if clt.state.get() == StateReconnecting {
+		clt.setState(StateConnecting, nil)
+	}
 	ticker := time.NewTicker(time.Second * 4)
 	defer ticker.Stop()
 
 	var connection *websocket.Conn
+	var err error
 
 	for ok := true; ok; ok = (connection == nil) {
 		select {
 		case <-ticker.C:
-			connection, _, err = websocket.DefaultDialer.Dial(u.String(), nil)
+			connection, err = clt.dial()
 			if err != nil {
 				logger.Info("Dial: ", err)
 			} else {
 				ticker.Stop()
 			}
 			break
+		case <-clt.done:
+			return
 		}
 	}
 
-	client.ws = connection
+	if clt.serverKey != nil {
+		// keys of the session depend on a fresh ephemeral key
+		if clt.ephemeral, err = newKeyPair(nil); err != nil {
+			connection.Close()
+			clt.stop(err)
+			return
+		}
+		clt.hello.Key = clt.ephemeral.public
+		if clt.hello.Proof, err = clt.proof(); err != nil {
+			connection.Close()
+			clt.stop(err)
+			return
+		}
+	}
+
+	l := clt.newLink(connection, clt.dispatcher)
+	clt.linksMu.Lock()
+	clt.links = nil
+	clt.pending = l
+	clt.linksMu.Unlock()
+
+	// Initialize connection with master
+	clt.setState(StateAuthenticating, nil)
+	l.send(&Data{
+		ConnectionState: STATE_CONNECT,
+		Handshake:       clt.hello,
+	})
+	l.start()
+}
+
+// connect to the best reachable endpoint. The bypass route to the server
+// is kept only for the endpoint in use, while probing all of them need it.
+func (clt *Client) dial() (*websocket.Conn, error) {
+	candidates := clt.endpoints
+	if len(candidates) > 1 {
+		clt.bypass(clt.endpoints)
+		candidates = rankEndpoints(clt.endpoints)
+		if len(candidates) == 0 {
+			return nil, errNoEndpoint
+		}
+	}
+
+	var err error
+	for _, e := range candidates {
+		clt.bypass([]endpoint{e})
+		logger.Debug("Connecting to ", e.url(clt.path))
+		var ws *websocket.Conn
+		ws, _, err = clt.dialer.Dial(e.url(clt.path), nil)
+		if err != nil {
+			logger.Info("Dial", e.addr(), err)
+			continue
+		}
+		if e != clt.endpoint {
+			logger.Info("Switched to endpoint", e.addr())
+		}
+		clt.endpoint = e
+		clt.url = e.url(clt.path)
+		return ws, nil
+	}
+	return nil, err
+}
 
-	defer connection.Close()
+// route the endpoints outside the tunnel and remove routes of other ones
+func (clt *Client) bypass(endpoints []endpoint) {
+	if clt.netstack != nil {
+		return
+	}
+	clt.routesMu.Lock()
+	defer clt.routesMu.Unlock()
+	keep := make(map[string]bool)
+	for _, e := range endpoints {
+		keep[e.host+"/32"] = true
+	}
+	bypassed := clt.bypassed[:0]
+	for _, dest := range clt.bypassed {
+		if keep[dest] {
+			bypassed = append(bypassed, dest)
+			delete(keep, dest)
+			continue
+		}
+		delRoute(dest)
+		clt.forgetRoute(dest)
+	}
+	for dest := range keep {
+		addRoute(dest, clt.gateway, clt.nic)
+		clt.routes = append(clt.routes, dest)
+		bypassed = append(bypassed, dest)
+	}
+	clt.bypassed = bypassed
+}
 
-	client.state = STATE_INIT
+// remove route from the list deleted on cleanup, routesMu is held
+func (clt *Client) forgetRoute(dest string) {
+	for i, r := range clt.routes {
+		if r == dest {
+			clt.routes = append(clt.routes[:i], clt.routes[i+1:]...)
+			return
+		}
+	}
+}
+
+// proof of our name for the current ephemeral key, nil without a key
+func (clt *Client) proof() ([]byte, error) {
+	if clt.identity == nil {
+		return nil, nil
+	}
+	return identityProof(clt.identity.private, clt.serverKey, clt.ephemeral.public, clt.hello.Name)
+}
+
+// Done returns a channel closed when the client stops
+func (clt *Client) Done() <-chan struct{} {
+	return clt.done
+}
 
-	client.ws.SetReadLimit(maxMessageSize)
-	client.ws.SetReadDeadline(time.Now().Add(pongWait))
-	client.ws.SetPongHandler(func(string) error {
-		client.ws.SetReadDeadline(time.Now().Add(pongWait))
-		logger.Debug("Pong received")
+// Err returns the error which stopped the client, nil while it runs or
+// after Close
+func (clt *Client) Err() error {
+	if !clt.closed() {
 		return nil
+	}
+	return clt.err
+}
+
+// Close sends queued packets, disconnects from the server and removes the
+// interface and routes. Returns the first error of the cleanup.
+func (clt *Client) Close() error {
+	clt.stop(nil)
+	return clt.closeErr
+}
+
+func (clt *Client) stop(err error) {
+	clt.closeOnce.Do(func() {
+		atomic.StoreInt32(&clt.stopping, 1)
+		clt.err = err
+		clt.setState(StateClosed, err)
+
+		clt.linksMu.RLock()
+		links := append([]*link(nil), clt.links...)
+		if clt.pending != nil {
+			links = append(links, clt.pending)
+		}
+		clt.linksMu.RUnlock()
+		deadline := time.Now().Add(drainWait)
+		for _, l := range links {
+			l.drain(deadline, websocket.CloseNormalClosure, "Client disconnecting")
+		}
+
+		close(clt.done)
+
+		for _, l := range clt.listeners {
+			l.Close()
+		}
+		clt.scriptDown()
+		if clt.dns != nil {
+			if err := clt.dns.restore(); err != nil {
+				logger.Error("Restoring DNS:", err)
+				clt.closeErr = err
+			}
+		}
+		if err := clt.delRoutes(); err != nil && clt.closeErr == nil {
+			clt.closeErr = err
+		}
+		if clt.killSwitch != nil {
+			if err == nil {
+				if err := RemoveKillSwitch(); err != nil && clt.closeErr == nil {
+					clt.closeErr = err
+				}
+			} else {
+				logger.Warning("Kill switch stays active, remove it with ws-vpn -unblock")
+			}
+		}
+		// the kernel removes the address with the interface
+		if clt.iface != nil {
+			if err := clt.iface.Close(); err != nil && clt.closeErr == nil {
+				clt.closeErr = err
+			}
+		}
+		logger.Info("Client stopped")
+		if clt.opts.OnDisconnect != nil {
+			clt.opts.OnDisconnect(err)
+		}
 	})
+}
 
-	go client.writePump()
+func (clt *Client) newLink(ws *websocket.Conn, dispatch func(*link, *Data)) *link {
+	l := newLink(ws, dispatch, clt.linkClosed)
+	l.compress = clt.compress
+	l.keepalive(clt.pingInterval, clt.pingTimeout)
+	return l
+}
 
-	// Initialize connection with master
-	client.data <- &Data{
+// open another websocket and join it to the session
+func (clt *Client) join() {
+	clt.linksMu.RLock()
+	n := len(clt.links)
+	clt.linksMu.RUnlock()
+	if n >= clt.cfg.Connections || clt.closed() {
+		return
+	}
+	ws, _, err := clt.dialer.Dial(clt.url, nil)
+	if err != nil {
+		logger.Info("Dial: ", err)
+		clt.rejoin()
+		return
+	}
+	l := clt.newLink(ws, clt.joinDispatcher)
+	// queued before the link runs, it can't be closed yet
+	l.send(&Data{
 		ConnectionState: STATE_CONNECT,
+		Handshake:       &Handshake{Name: clt.cfg.Name, Session: clt.session},
+	})
+	l.start()
+}
+
+// join again later while the session is alive
+func (clt *Client) rejoin() {
+	go func() {
+		time.Sleep(4 * time.Second)
+		select {
+		case <-clt.done:
+		default:
+			clt.join()
+		}
+	}()
+}
+
+// wait for server to accept joined websocket, then use it for packets
+func (clt *Client) joinDispatcher(l *link, d *Data) {
+	if reason, ok := parseError(d.Payload); ok {
+		d.release()
+		logger.Warning("Join rejected:", reason)
+		l.ws.Close()
+		return
+	}
+	var message Data
+	err := json.Unmarshal(d.Payload, &message)
+	d.release()
+	if err != nil || message.ConnectionState != STATE_CONNECT {
+		logger.Warning("Unexpected join reply")
+		l.ws.Close()
+		return
 	}
+	if message.Handshake != nil && message.Handshake.Batch {
+		l.batcher = newBatcher(time.Duration(clt.cfg.BatchDelay) * time.Millisecond)
+	}
+	l.dispatch = clt.dispatcher
 
-	for {
-		messageType, r, err := connection.ReadMessage()
-		if err != nil {
-			logger.Error("Read error:", err)
-			delRoute("0.0.0.0/1")
-			delRoute("128.0.0.0/1")
-			for _, dest := range client.routes {
-				delRoute(dest)
-			}
-			break
-		} else {
+	clt.linksMu.Lock()
+	clt.links = append(clt.links, l)
+	logger.Info("Session has", len(clt.links), "links")
+	clt.linksMu.Unlock()
+}
 
-			if messageType == websocket.TextMessage {
-				client.dispatcher(r)
+// remove closed websocket, the client stops with the last one
+func (clt *Client) linkClosed(l *link) {
+	clt.linksMu.Lock()
+	found := false
+	for i, cl := range clt.links {
+		if cl == l {
+			clt.links = append(clt.links[:i], clt.links[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if l == clt.pending {
+		clt.pending = nil
+		found = true
+	}
+	l.shutdown()
+	n := len(clt.links)
+	clt.linksMu.Unlock()
+
+	if n == 0 && found {
+		goingAway := websocket.IsCloseError(l.err, websocket.CloseGoingAway)
+		if (goingAway || len(clt.endpoints) > 1) && atomic.LoadInt32(&clt.stopping) == 0 {
+			if goingAway {
+				logger.Info("Server going away, reconnecting")
+			} else {
+				logger.Info("Connection to", clt.endpoint.addr(), "lost, failing over")
 			}
-
+			clt.setState(StateReconnecting, l.err)
+			go clt.connect()
+			return
 		}
+		clt.stop(errDisconnected)
+	} else if clt.session != "" {
+		clt.rejoin()
+	}
+}
 
+// queue packet on one of the links, the record is released when dropped
+func (clt *Client) send(d *Data) bool {
+	clt.linksMu.RLock()
+	defer clt.linksMu.RUnlock()
+	if len(clt.links) == 0 {
+		d.release()
+		return false
 	}
-	return errors.New("Not expected to exit")
+	l := pickLink(clt.links, d.Payload)
+	if clt.sealer != nil {
+		d = clt.sealer.seal(d)
+	}
+	return l.send(d)
 }
 
-func (clt *Client) dispatcher(p []byte) {
-	logger.Debug("Dispatcher: ", clt.state)
-	switch clt.state {
-	case STATE_INIT:
-		logger.Debug("STATE_INIT")
+// handle message read from the websocket, takes ownership of the record
+func (clt *Client) dispatcher(l *link, d *Data) {
+	if reason, ok := parseError(d.Payload); ok {
+		d.release()
+		logger.Error("Server error:", reason)
+		clt.stop(errors.New(reason))
+		return
+	}
+
+	state := clt.state.get()
+	logger.Debug("Dispatcher: ", state)
+	switch state {
+	case StateAuthenticating:
 		var message Data
-		if err := json.Unmarshal(p, &message); err != nil {
-			clt.ws.Close()
-			close(clt.data)
-			logger.Panic(err)
-		}
-		if message.ConnectionState == STATE_CONNECT {
-
-			ipStr := string(message.Payload)
-			ip, subnet, _ := net.ParseCIDR(ipStr)
-			setTunIP(clt.iface, ip, subnet)
-			if clt.cfg.RedirectGateway {
-				err := redirectGateway(clt.iface.Name(), tun_peer.String())
-				if err != nil {
-					logger.Error("Redirect gateway error", err.Error())
-				}
+		err := json.Unmarshal(d.Payload, &message)
+		d.release()
+		if err == nil && message.ConnectionState != STATE_CONNECT {
+			err = errUnexpectedMessage
+		}
+		if err == nil {
+			err = clt.handshake(l, &message)
+		}
+		if err != nil {
+			logger.Error("Handshake:", err)
+			l.fail(websocket.ClosePolicyViolation, err)
+			clt.stop(err)
+		}
+	case StateEstablished:
+		var err error
+		if clt.sealer != nil {
+			if d, err = clt.sealer.open(d); err != nil {
+				logger.Debug(err)
+				return
 			}
+		}
+		select {
+		case clt.toIface <- d:
+		case <-clt.done:
+			d.release()
+		}
+	default:
+		d.release()
+	}
+}
+
+// apply the handshake reply of the server and bring the tunnel up
+func (clt *Client) handshake(l *link, message *Data) error {
+	var err error
+	if clt.serverKey != nil {
+		if message.Handshake == nil || len(message.Handshake.Key) == 0 {
+			return errNoEncryption
+		}
+		clt.sealer, err = clientHandshake(clt.ephemeral, clt.serverKey, clt.hello, message.Handshake, message.Payload)
+		if err != nil {
+			return err
+		}
+	}
+	if message.Handshake != nil {
+		if message.Handshake.Batch {
+			l.batcher = newBatcher(time.Duration(clt.cfg.BatchDelay) * time.Millisecond)
+		}
+		clt.session = message.Handshake.Session
+	}
+
+	ip, subnet, err := net.ParseCIDR(string(message.Payload))
+	if err != nil {
+		return err
+	}
+	reconnect := clt.ip != nil
+	if !ip.Equal(clt.ip) {
+		clt.scriptDown()
+		clt.setAddress(ip, subnet)
+		if err := runScript("up", clt.cfg.Up, clt.scriptEnv, clt.scriptWait()); err != nil {
+			// the next handshake assigns the address and runs up again
+			clt.clearAddress()
+			return err
+		}
+		clt.up = true
+	}
+	servers, domains, fallback := clt.cfg.Dns, clt.cfg.DnsDomain, true
+	if len(servers) == 0 && message.Handshake != nil && len(message.Handshake.Dns) > 0 {
+		if err := parseDns(message.Handshake.Dns); err != nil {
+			return err
+		}
+		if err := parseDomain(message.Handshake.DnsDomain); err != nil {
+			return err
+		}
+		servers = message.Handshake.Dns
+		if !clt.cfg.RedirectGateway {
+			// only client names go to the pushed resolver
+			domains = []string{message.Handshake.DnsDomain}
+			fallback = false
+		}
+	}
+	if clt.dns == nil && clt.netstack == nil && len(servers) > 0 {
+		if clt.dns, err = setupDns(clt.iface.Name(), servers, domains, fallback); err != nil {
+			return err
+		}
+	}
 
-			clt.state = STATE_CONNECTED
-			clt.handleInterface()
+	// packets of the new session go out only now, sealed with its keys
+	clt.linksMu.Lock()
+	clt.links = []*link{l}
+	clt.pending = nil
+	clt.linksMu.Unlock()
+
+	clt.setState(StateEstablished, nil)
+	if !reconnect {
+		clt.handleInterface()
+	}
+	if clt.opts.OnConnect != nil {
+		clt.opts.OnConnect(&net.IPNet{IP: ip, Mask: subnet.Mask})
+	}
+
+	if clt.session != "" {
+		for i := 1; i < clt.cfg.Connections; i++ {
+			go clt.join()
 		}
-	case STATE_CONNECTED:
-		clt.toIface <- p
+	}
+	return nil
+}
 
+// move to the state, invalid transitions are logged and ignored
+func (clt *Client) setState(state State, cause error) {
+	if err := clt.state.transition(state, cause); err != nil {
+		logger.Warning(err)
 	}
 }
 
+// State returns the current state of the session
+func (clt *Client) State() State {
+	return clt.state.get()
+}
+
+// Subscribe adds a hook called on every state transition of the session.
+// Hooks run on connection goroutines, one at a time and in the order of the
+// transitions, and must not block.
+func (clt *Client) Subscribe(hook StateHook) {
+	clt.state.subscribe(hook)
+}
+
+// configure the address assigned by the server, after a reconnect it can
+// differ from the previous one
+func (clt *Client) setAddress(ip net.IP, subnet *net.IPNet) {
+	var err error
+	if clt.netstack != nil {
+		if clt.listeners == nil {
+			err = clt.startUserspace(ip)
+		} else {
+			err = clt.netstack.setIP(ip)
+		}
+		if err != nil {
+			logger.Error("Userspace stack error", err.Error())
+		}
+		clt.ip = ip
+		clt.subnet = subnet
+		return
+	}
+
+	if clt.ip != nil {
+		// removing the address removes routes through the peer too
+		if err := flushTunIP(clt.iface); err != nil {
+			logger.Error("Interface address error", err.Error())
+		}
+		clt.delRedirectRoutes()
+	}
+	clt.ip = ip
+	clt.subnet = subnet
+	clt.peer, err = setTunIP(clt.iface, ip, subnet)
+	if err != nil {
+		logger.Error("Interface address error", err.Error())
+		return
+	}
+	if clt.cfg.RedirectGateway {
+		if err := redirectGateway(clt.iface.Name(), clt.peer.String()); err != nil {
+			logger.Error("Redirect gateway error", err.Error())
+			return
+		}
+		clt.routesMu.Lock()
+		clt.routes = append(clt.routes, redirectRoutes...)
+		clt.routesMu.Unlock()
+	}
+}
+
+// remove the address after a failed up script
+func (clt *Client) clearAddress() {
+	if clt.netstack == nil && clt.ip != nil {
+		if err := flushTunIP(clt.iface); err != nil {
+			logger.Error("Interface address error", err.Error())
+		}
+		clt.delRedirectRoutes()
+	}
+	clt.ip = nil
+	clt.subnet = nil
+	clt.up = false
+}
+
+// environment of hook scripts
+func (clt *Client) scriptEnv() []string {
+	return append(ifaceEnv(clt.iface, clt.ip, clt.peer, clt.subnet, clt.mtu),
+		"VPN_SERVER="+clt.endpoint.host,
+		"VPN_CLIENT_NAME="+clt.cfg.Name,
+	)
+}
+
+func (clt *Client) scriptWait() time.Duration {
+	return time.Duration(clt.cfg.ScriptTimeout) * time.Second
+}
+
+// run down script when up ran for the current address
+func (clt *Client) scriptDown() {
+	if !clt.up {
+		return
+	}
+	clt.up = false
+	if err := runScript("down", clt.cfg.Down, clt.scriptEnv, clt.scriptWait()); err != nil {
+		logger.Warning(err)
+	}
+}
+
+// forget redirect routes, they are gone with the address
+func (clt *Client) delRedirectRoutes() {
+	clt.routesMu.Lock()
+	defer clt.routesMu.Unlock()
+	routes := clt.routes[:0]
+	for _, dest := range clt.routes {
+		if dest != redirectRoutes[0] && dest != redirectRoutes[1] {
+			routes = append(routes, dest)
+		}
+	}
+	clt.routes = routes
+}
+
+// configure the userspace stack and start local proxies and forwards
+func (clt *Client) startUserspace(ip net.IP) error {
+	if err := clt.netstack.setIP(ip); err != nil {
+		return err
+	}
+	if clt.cfg.Socks != "" {
+		l, err := serveSocks(clt.cfg.Socks, clt.netstack.DialContext)
+		if err != nil {
+			return err
+		}
+		clt.listeners = append(clt.listeners, l)
+	}
+	if clt.cfg.HttpProxy != "" {
+		l, err := serveHttpProxy(clt.cfg.HttpProxy, clt.netstack.DialContext)
+		if err != nil {
+			return err
+		}
+		clt.listeners = append(clt.listeners, l)
+	}
+	for _, entry := range clt.cfg.Forward {
+		local, remote, _ := parseForward(entry)
+		l, err := serveForward(local, remote, clt.netstack.DialContext)
+		if err != nil {
+			return err
+		}
+		clt.listeners = append(clt.listeners, l)
+	}
+	return nil
+}
+
 func (clt *Client) handleInterface() {
 	// network packet to interface
 	go func() {
 		for {
-			hp := <-clt.toIface
-			_, err := clt.iface.Write(hp)
+			var hp *Data
+			select {
+			case hp = <-clt.toIface:
+			case <-clt.done:
+				return
+			}
+			_, err := clt.iface.Write(hp.Payload)
+			hp.release()
 			if err != nil {
-				logger.Error(err.Error())
+				if !clt.closed() {
+					logger.Error(err.Error())
+				}
 				return
 			}
 			logger.Debug("Write to interface")
@@ -201,73 +919,42 @@ func (clt *Client) handleInterface() {
 	}()
 
 	go func() {
-		packet := make([]byte, IFACE_BUFSIZE)
 		for {
-			plen, err := clt.iface.Read(packet)
+			d := newPacket()
+			plen, err := clt.iface.Read(d.buf)
 			if err != nil {
-				logger.Error(err)
+				if !clt.closed() {
+					logger.Error(err)
+				}
+				d.release()
 				break
 			}
-			clt.data <- &Data{
-				ConnectionState: STATE_CONNECTED,
-				Payload:         packet[:plen],
-			}
-
+			d.Payload = d.buf[:plen]
+			clt.send(d)
 		}
 	}()
 }
 
-func (clt *Client) writePump() {
-
-	ticker := time.NewTicker(pingPeriod)
-
-	defer func() {
-		ticker.Stop()
-		clt.ws.Close()
-	}()
-
-	for {
-		select {
-		case message, ok := <-clt.data:
-			if !ok {
-				clt.write(websocket.CloseMessage, &Data{})
-				return
-			}
-			if err := clt.write(websocket.TextMessage, message); err != nil {
-				logger.Error("writePump error", err)
-			}
-		case <-ticker.C:
-			if err := clt.ws.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait)); err != nil {
-				logger.Error("Send ping error", err)
-			}
-		}
+// return true once the client stopped
+func (clt *Client) closed() bool {
+	select {
+	case <-clt.done:
+		return true
+	default:
+		return false
 	}
 }
 
-func (clt *Client) write(mt int, message *Data) error {
-
-	if message.ConnectionState == STATE_CONNECTED {
-		return clt.ws.WriteMessage(mt, message.Payload)
-	} else {
-		s, err := json.Marshal(message)
-		if err != nil {
-			logger.Panic(err)
+// delete routes added by the client
+func (clt *Client) delRoutes() error {
+	clt.routesMu.Lock()
+	defer clt.routesMu.Unlock()
+	var first error
+	for i := len(clt.routes) - 1; i >= 0; i-- {
+		if err := delRoute(clt.routes[i]); err != nil && first == nil {
+			first = err
 		}
-		return clt.ws.WriteMessage(mt, s)
-	}
-
-}
-
-func (clt *Client) cleanUp() {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-	<-c
-	logger.Info("Cleaning Up")
-	delRoute("0.0.0.0/1")
-	delRoute("128.0.0.0/1")
-	for _, dest := range clt.routes {
-		delRoute(dest)
 	}
-
-	os.Exit(0)
+	clt.routes = clt.routes[:0]
+	return first
 }
@@ -0,0 +1,352 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// leases not renewed within leaseTTL belong to crashed nodes
+	leaseTTL       = 30 * time.Second
+	clusterRefresh = 10 * time.Second
+)
+
+var (
+	errClusterBackend = errors.New("Unknown cluster backend, use file:// or redis://")
+	errClusterNode    = errors.New("clusterNode has to be the IP address of this node")
+	errRaftBackend    = errors.New("Embedded raft cluster backend is not supported, use file:// or redis://")
+	errLeaseLost      = errors.New("Address lease was taken by another node")
+	errLeaseExpired   = errors.New("Address lease could not be renewed")
+)
+
+// shared table of client addresses and the nodes holding them
+type leaseBackend interface {
+	// take the address for the node or renew its lease, false when another
+	// node holds it
+	acquire(ip, node string, ttl time.Duration) (bool, error)
+	// give up the address if the node holds it
+	release(ip, node string) error
+	// live leases, address to node
+	leases() (map[string]string, error)
+	close() error
+}
+
+// open the backend given as file:///path or redis://[:password@]host:port[/db]
+func newLeaseBackend(uri string) (leaseBackend, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		return newFileLeases(u.Path), nil
+	case "redis":
+		return newRedisLeases(u)
+	case "raft":
+		return nil, errRaftBackend
+	}
+	return nil, errClusterBackend
+}
+
+// server node sharing the address pool with other nodes. Addresses of
+// clients on other nodes are routed to the node holding the lease.
+type cluster struct {
+	backend leaseBackend
+	// address of this node, other nodes route to it
+	node string
+	pool *VpnIpPool
+
+	// called when this node lost the lease of a client address, the
+	// client has to go before another node hands the address out
+	lost func(ip net.IP, err error)
+
+	mu sync.Mutex
+	// leases held by this node and when they were last renewed
+	owned map[string]time.Time
+	// client addresses routed to other nodes
+	routes map[string]string
+}
+
+func newCluster(uri, node string, pool *VpnIpPool) (*cluster, error) {
+	ip := net.ParseIP(node)
+	if ip == nil || ip.To4() == nil {
+		return nil, errClusterNode
+	}
+	backend, err := newLeaseBackend(uri)
+	if err != nil {
+		return nil, err
+	}
+	c := &cluster{
+		backend: backend,
+		node:    ip.String(),
+		pool:    pool,
+		owned:   make(map[string]time.Time),
+		routes:  make(map[string]string),
+	}
+	pool.cluster = c
+	return c, nil
+}
+
+func (c *cluster) acquire(ip net.IP) (bool, error) {
+	ok, err := c.backend.acquire(ip.String(), c.node, leaseTTL)
+	if err != nil || !ok {
+		return false, err
+	}
+	c.mu.Lock()
+	c.owned[ip.String()] = time.Now()
+	c.mu.Unlock()
+	return true, nil
+}
+
+func (c *cluster) release(ip net.IP) {
+	c.mu.Lock()
+	delete(c.owned, ip.String())
+	c.mu.Unlock()
+	if err := c.backend.release(ip.String(), c.node); err != nil {
+		logger.Warning("Releasing lease of", ip, err)
+	}
+}
+
+// renew leases of this node and route clients of other nodes until done
+func (c *cluster) run(done <-chan struct{}) {
+	ticker := time.NewTicker(clusterRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.refresh(); err != nil {
+				logger.Error("Cluster refresh:", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// renew the leases of this node and sync routes to clients of other nodes.
+// A failed renewal doesn't stop the others, the first error is returned.
+func (c *cluster) refresh() error {
+	c.mu.Lock()
+	owned := make(map[string]time.Time, len(c.owned))
+	for ip, renewed := range c.owned {
+		owned[ip] = renewed
+	}
+	c.mu.Unlock()
+
+	var first error
+	for ip, renewed := range owned {
+		ok, err := c.backend.acquire(ip, c.node, leaseTTL)
+		switch {
+		case err != nil:
+			if first == nil {
+				first = err
+			}
+			// the lease expires before the next refresh
+			if time.Since(renewed)+clusterRefresh >= leaseTTL {
+				c.drop(ip, errLeaseExpired)
+			}
+		case !ok:
+			c.drop(ip, errLeaseLost)
+		default:
+			c.mu.Lock()
+			if _, ok := c.owned[ip]; ok {
+				c.owned[ip] = time.Now()
+			}
+			c.mu.Unlock()
+		}
+	}
+
+	table, err := c.backend.leases()
+	if err != nil {
+		if first == nil {
+			first = err
+		}
+		return first
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for ip, node := range table {
+		if _, ok := c.owned[ip]; ok || node == c.node || c.routes[ip] == node {
+			continue
+		}
+		if err := peerRoute("replace", ip, node); err != nil {
+			logger.Warning(err.Error())
+			continue
+		}
+		c.routes[ip] = node
+		c.pool.hold(net.ParseIP(ip))
+	}
+	for ip, node := range c.routes {
+		if table[ip] == node {
+			continue
+		}
+		peerRoute("del", ip, node)
+		delete(c.routes, ip)
+		if _, ok := c.owned[ip]; !ok {
+			c.pool.unhold(net.ParseIP(ip))
+		}
+	}
+	return first
+}
+
+// forget a lease this node can't keep and disconnect its client
+func (c *cluster) drop(ip string, err error) {
+	logger.Warning("Lease of", ip, err)
+	c.mu.Lock()
+	delete(c.owned, ip)
+	c.mu.Unlock()
+	if c.lost != nil {
+		c.lost(net.ParseIP(ip), err)
+	}
+}
+
+// give up the leases of this node and remove the routes to other nodes
+func (c *cluster) close() error {
+	c.mu.Lock()
+	owned := c.owned
+	c.owned = make(map[string]time.Time)
+	routes := c.routes
+	c.routes = make(map[string]string)
+	c.mu.Unlock()
+
+	for ip := range owned {
+		if err := c.backend.release(ip, c.node); err != nil {
+			logger.Warning("Releasing lease of", ip, err)
+		}
+	}
+	for ip, node := range routes {
+		peerRoute("del", ip, node)
+	}
+	return c.backend.close()
+}
+
+// add, replace or delete the host route of a client to its node
+func peerRoute(op, ip, node string) error {
+	sargs := fmt.Sprintf("-4 route %s %s/32 via %s", op, ip, node)
+	logger.Info("ip", sargs)
+	return exec.Command("ip", strings.Split(sargs, " ")...).Run()
+}
+
+// lease table in a JSON file on a filesystem shared by the nodes, updates
+// are serialized with flock on a separate lock file
+type fileLeases struct {
+	file string
+}
+
+type fileLease struct {
+	Node    string `json:"node"`
+	Expires int64  `json:"expires"`
+}
+
+func newFileLeases(file string) *fileLeases {
+	return &fileLeases{file: file}
+}
+
+// load the table under the lock, fn returns true when it changed the table
+func (f *fileLeases) update(fn func(table map[string]fileLease) bool) error {
+	lock, err := os.OpenFile(f.file+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	table := make(map[string]fileLease)
+	b, err := ioutil.ReadFile(f.file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &table); err != nil {
+			return err
+		}
+	}
+	now := time.Now().UnixNano()
+	for ip, l := range table {
+		if l.Expires < now {
+			delete(table, ip)
+		}
+	}
+	if !fn(table) {
+		return nil
+	}
+
+	b, err = json.Marshal(table)
+	if err != nil {
+		return err
+	}
+	tmp := f.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.file)
+}
+
+func (f *fileLeases) acquire(ip, node string, ttl time.Duration) (bool, error) {
+	ok := false
+	err := f.update(func(table map[string]fileLease) bool {
+		if l, found := table[ip]; found && l.Node != node {
+			return false
+		}
+		table[ip] = fileLease{Node: node, Expires: time.Now().Add(ttl).UnixNano()}
+		ok = true
+		return true
+	})
+	return ok, err
+}
+
+func (f *fileLeases) release(ip, node string) error {
+	return f.update(func(table map[string]fileLease) bool {
+		if l, found := table[ip]; !found || l.Node != node {
+			return false
+		}
+		delete(table, ip)
+		return true
+	})
+}
+
+func (f *fileLeases) leases() (map[string]string, error) {
+	leases := make(map[string]string)
+	err := f.update(func(table map[string]fileLease) bool {
+		for ip, l := range table {
+			leases[ip] = l.Node
+		}
+		return false
+	})
+	return leases, err
+}
+
+func (f *fileLeases) close() error {
+	return nil
+}
@@ -0,0 +1,150 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// backend failing for addresses in err and refusing those in taken
+type testLeases struct {
+	err   map[string]error
+	taken map[string]bool
+	table map[string]string
+}
+
+func (b *testLeases) acquire(ip, node string, ttl time.Duration) (bool, error) {
+	if err := b.err[ip]; err != nil {
+		return false, err
+	}
+	return !b.taken[ip], nil
+}
+
+func (b *testLeases) release(ip, node string) error {
+	return nil
+}
+
+func (b *testLeases) leases() (map[string]string, error) {
+	return b.table, nil
+}
+
+func (b *testLeases) close() error {
+	return nil
+}
+
+func TestClusterRefresh(t *testing.T) {
+	errDown := errors.New("backend down")
+	now := time.Now()
+	backend := &testLeases{
+		err: map[string]error{
+			"10.1.1.3": errDown,
+			"10.1.1.5": errDown,
+		},
+		taken: map[string]bool{"10.1.1.7": true},
+		table: map[string]string{},
+	}
+	c := &cluster{
+		backend: backend,
+		node:    "10.0.0.11",
+		owned: map[string]time.Time{
+			// renewal failed, lease still valid at the next refresh
+			"10.1.1.3": now,
+			// renewal failed, lease expires before the next refresh
+			"10.1.1.5": now.Add(clusterRefresh - leaseTTL),
+			// taken by another node
+			"10.1.1.7": now,
+			// renewed
+			"10.1.1.9": now.Add(-clusterRefresh),
+		},
+		routes: make(map[string]string),
+	}
+	lost := make(map[string]error)
+	c.lost = func(ip net.IP, err error) {
+		lost[ip.String()] = err
+	}
+
+	if err := c.refresh(); err != errDown {
+		t.Errorf("refresh = %v, want %v", err, errDown)
+	}
+	want := map[string]error{"10.1.1.5": errLeaseExpired, "10.1.1.7": errLeaseLost}
+	if len(lost) != len(want) {
+		t.Errorf("lost %v, want %v", lost, want)
+	}
+	for ip, err := range want {
+		if lost[ip] != err {
+			t.Errorf("lease of %s: lost with %v, want %v", ip, lost[ip], err)
+		}
+		if _, ok := c.owned[ip]; ok {
+			t.Errorf("lost lease of %s still owned", ip)
+		}
+	}
+	if renewed, ok := c.owned["10.1.1.3"]; !ok || !renewed.Equal(now) {
+		t.Errorf("failed renewal of a valid lease changed it to %v, %v", renewed, ok)
+	}
+	if renewed := c.owned["10.1.1.9"]; !renewed.After(now) {
+		t.Errorf("lease renewed after a failed one wasn't updated: %v", renewed)
+	}
+}
+
+func TestFileLeases(t *testing.T) {
+	f := newFileLeases(filepath.Join(t.TempDir(), "leases.json"))
+	acquire := func(ip, node string, ttl time.Duration, want bool) {
+		t.Helper()
+		ok, err := f.acquire(ip, node, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Errorf("acquire(%s, %s) = %v, want %v", ip, node, ok, want)
+		}
+	}
+
+	acquire("10.1.1.3", "a", time.Minute, true)
+	acquire("10.1.1.3", "a", time.Minute, true)
+	acquire("10.1.1.3", "b", time.Minute, false)
+	acquire("10.1.1.5", "b", time.Minute, true)
+	// expired leases can be taken over
+	acquire("10.1.1.7", "a", -time.Second, true)
+	acquire("10.1.1.7", "b", time.Minute, true)
+
+	if err := f.release("10.1.1.5", "a"); err != nil {
+		t.Fatal(err)
+	}
+	leases, err := f.leases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"10.1.1.3": "a", "10.1.1.5": "b", "10.1.1.7": "b"}
+	if len(leases) != len(want) {
+		t.Errorf("leases = %v, want %v", leases, want)
+	}
+	for ip, node := range want {
+		if leases[ip] != node {
+			t.Errorf("lease of %s held by %q, want %q", ip, leases[ip], node)
+		}
+	}
+
+	if err := f.release("10.1.1.5", "b"); err != nil {
+		t.Fatal(err)
+	}
+	acquire("10.1.1.5", "a", time.Minute, true)
+}
@@ -0,0 +1,113 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"compress/flate"
+	"fmt"
+)
+
+// Compression uses the permessage-deflate extension of the websocket
+// (RFC 7692), negotiated in the websocket upgrade, so it is only used when
+// both sides enable it. Small packets are sent uncompressed.
+var compressions = map[string]bool{
+	"deflate": true,
+}
+
+// packets smaller than this are not worth compressing
+const compressMinSize = 128
+
+// the decision of one sample holds for this many messages
+const compressSample = 16
+
+// check configured algorithms, returns whether compression is enabled
+func compressionEnabled(list []string) (bool, error) {
+	enabled := false
+	for _, name := range list {
+		if !compressions[name] {
+			return false, fmt.Errorf("Unsupported compression %s", name)
+		}
+		enabled = true
+	}
+	return enabled, nil
+}
+
+// Decides per message whether compression pays off. Every message of the
+// websocket is deflated on its own, so one deflated into a counter shows
+// what the extension would send. A sample is taken every compressSample
+// messages, when it doesn't shrink the messages until the next sample
+// are sent uncompressed. Used by the writer of a link only.
+type compressor struct {
+	w    *flate.Writer
+	size byteCounter
+	// messages left until the next sample
+	next int
+	// result of the last sample
+	shrinks bool
+
+	// bytes of sampled messages before and after deflate
+	in, out uint64
+	// messages sent uncompressed because the sample didn't shrink
+	skipped uint64
+}
+
+// counts bytes written
+type byteCounter int
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+func newCompressor() *compressor {
+	c := new(compressor)
+	// the websocket library deflates at the best speed too
+	c.w, _ = flate.NewWriter(&c.size, flate.BestSpeed)
+	return c
+}
+
+// report whether the message should be sent compressed
+func (c *compressor) worth(p []byte) bool {
+	if len(p) < compressMinSize {
+		return false
+	}
+	if c.next > 0 {
+		c.next--
+	} else {
+		c.next = compressSample - 1
+		c.size = 0
+		c.w.Reset(&c.size)
+		c.w.Write(p)
+		c.w.Flush()
+		c.in += uint64(len(p))
+		c.out += uint64(c.size)
+		c.shrinks = int(c.size) < len(p)
+	}
+	if !c.shrinks {
+		c.skipped++
+	}
+	return c.shrinks
+}
+
+// deflated size of the sampled messages relative to their size
+func (c *compressor) ratio() float64 {
+	if c.in == 0 {
+		return 0
+	}
+	return float64(c.out) / float64(c.in)
+}
@@ -0,0 +1,201 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCompressionEnabled(t *testing.T) {
+	tests := []struct {
+		list    []string
+		enabled bool
+		valid   bool
+	}{
+		{nil, false, true},
+		{[]string{"deflate"}, true, true},
+		{[]string{"lz4"}, false, false},
+		{[]string{"deflate", "zstd"}, false, false},
+	}
+	for _, tt := range tests {
+		enabled, err := compressionEnabled(tt.list)
+		if enabled != tt.enabled || (err == nil) != tt.valid {
+			t.Errorf("%v: enabled %v, err %v", tt.list, enabled, err)
+		}
+	}
+}
+
+// counts bytes written to the connection
+type countingConn struct {
+	net.Conn
+	written *int64
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(c.written, int64(n))
+	return n, err
+}
+
+// websocket pair, bytes written by the client are counted
+func compressedPair(tb testing.TB, compress bool) (client, server *websocket.Conn, written *int64) {
+	written = new(int64)
+	up := upgrader
+	up.EnableCompression = compress
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = compress
+	dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return countingConn{conn, written}, nil
+	}
+	client, server = wsPairWith(tb, up, &dialer)
+	atomic.StoreInt64(written, 0)
+	return client, server, written
+}
+
+// payload resembling plain text traffic
+var textPacket = bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n"), 40)[:1400]
+
+func TestCompressedLink(t *testing.T) {
+	random := make([]byte, 1400)
+	rand.Read(random)
+
+	tests := []struct {
+		name     string
+		compress bool
+		payload  []byte
+		// bounds of bytes on the wire
+		min, max int
+	}{
+		{"text", true, textPacket, 0, len(textPacket) / 4},
+		{"text uncompressed", false, textPacket, len(textPacket), len(textPacket) + 14},
+		{"small packet", true, textPacket[:compressMinSize-1], compressMinSize - 1, compressMinSize + 13},
+		// not worth it, sent without deflate overhead
+		{"random", true, random, len(random), len(random) + 14},
+	}
+	for _, tt := range tests {
+		client, server, written := compressedPair(t, tt.compress)
+		l := newLink(client, nil, nil)
+		l.compress = tt.compress
+		d := newPacket()
+		d.Payload = d.buf[:copy(d.buf, tt.payload)]
+		if err := l.write(d); err != nil {
+			t.Fatal(err)
+		}
+		d.release()
+
+		_, got, err := readPacket(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Payload, tt.payload) {
+			t.Errorf("%s: payload changed", tt.name)
+		}
+		got.release()
+		if n := int(atomic.LoadInt64(written)); n < tt.min || n > tt.max {
+			t.Errorf("%s: %d bytes on the wire, want %d-%d", tt.name, n, tt.min, tt.max)
+		}
+	}
+}
+
+func TestCompressorSamples(t *testing.T) {
+	random := make([]byte, 1400)
+	rand.Read(random)
+	c := newCompressor()
+
+	if c.worth(textPacket[:compressMinSize-1]) {
+		t.Error("small packet compressed")
+	}
+	if !c.worth(textPacket) {
+		t.Error("text not compressed")
+	}
+	// the decision holds until the next sample
+	for i := 1; i < compressSample; i++ {
+		if !c.worth(random) {
+			t.Fatalf("message %d: sample ignored", i)
+		}
+	}
+	if r := c.ratio(); r <= 0 || r > 0.25 {
+		t.Errorf("ratio of text %.2f", r)
+	}
+	if c.worth(random) {
+		t.Error("random data compressed")
+	}
+	for i := 1; i < compressSample; i++ {
+		if c.worth(textPacket) {
+			t.Fatalf("message %d: sample ignored", i)
+		}
+	}
+	if c.skipped != compressSample {
+		t.Errorf("%d messages skipped, want %d", c.skipped, compressSample)
+	}
+	if !c.worth(textPacket) {
+		t.Error("text not compressed after the next sample")
+	}
+}
+
+// CPU time and ratio of bytes on the wire to packet bytes
+func BenchmarkCompression(b *testing.B) {
+	random := make([]byte, 1400)
+	rand.Read(random)
+	payloads := []struct {
+		name string
+		p    []byte
+	}{
+		{"text", textPacket},
+		{"random", random},
+	}
+	for _, payload := range payloads {
+		for _, compress := range []bool{false, true} {
+			mode := "off"
+			if compress {
+				mode = "deflate"
+			}
+			b.Run(payload.name+"/"+mode, func(b *testing.B) {
+				client, server, written := compressedPair(b, compress)
+				go discard(server)
+				l := newLink(client, nil, nil)
+				l.compress = compress
+				b.ReportAllocs()
+				b.SetBytes(int64(len(payload.p)))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					d := newPacket()
+					d.Payload = d.buf[:copy(d.buf, payload.p)]
+					if err := l.write(d); err != nil {
+						b.Fatal(err)
+					}
+					d.release()
+				}
+				b.StopTimer()
+				ratio := float64(atomic.LoadInt64(written)) / float64(b.N*len(payload.p))
+				b.ReportMetric(ratio, "wire/packet")
+			})
+		}
+	}
+}
@@ -18,27 +18,64 @@
 package vpn
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"github.com/gorilla/websocket"
-	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	writeWait      = 10 * time.Second
-	pongWait       = 60 * time.Second
-	pingPeriod     = (pongWait) / 2
+	writeWait = 10 * time.Second
+	pongWait  = 60 * time.Second
+	// below the common 30 and 60 second idle timeouts of NATs and proxies
+	pingPeriod     = 25 * time.Second
 	maxMessageSize = 1024 * 1024
+	// default time to flush queued packets on shutdown
+	drainWait = 5 * time.Second
+	// bytes counted per connection before they are added to the quota store
+	quotaChunk = 64 * 1024
 )
 
 type connection struct {
+	// transfer not added to the quota store yet, first for 64-bit alignment
+	unaccounted int64
+
 	id        int
-	ws        *websocket.Conn
-	server    *VpnServer
-	data      chan *Data
-	state     int
+	server    *Server
+	state     *stateMachine
 	ipAddress *net.IPNet
+	// real client address, see trustedProxies
+	remoteAddr string
+	// name sent by the client in the handshake
+	identity string
+	group    string
+	// identity proven with its key
+	authenticated bool
+
+	limitUp     *tokenBucket
+	limitDown   *tokenBucket
+	quota       int64
+	quotaAction string
+	quotaRate   int
+	overQuota   int32
+
+	// token other websockets of the client join the session with
+	session string
+	// websockets carrying the session
+	links   []*link
+	linksMu sync.RWMutex
+
+	// packet batching negotiated
+	batch      bool
+	batchDelay time.Duration
+	// payload encryption, nil when not negotiated
+	sealer *sealer
 }
 
 var upgrader = websocket.Upgrader{
@@ -46,11 +83,38 @@ var upgrader = websocket.Upgrader{
 	WriteBufferSize: maxMessageSize,
 }
 
-var maxId int = 0
+var errQuotaExceeded = errors.New("Transfer quota exceeded")
+
+var errUnknownSession = errors.New("Unknown session")
+
+var errBadHandshake = errors.New("Malformed handshake")
+
+var errUnexpectedMessage = errors.New("Unexpected message")
 
-func NewConnection(ws *websocket.Conn, server *VpnServer) *connection {
+var errShuttingDown = errors.New(shutdownReason)
+
+var errRejectedByScript = errors.New("Rejected by client-connect script")
+
+var errPingTimeout = errors.New("pingTimeout has to be longer than pingInterval")
+
+// return ping interval and timeout from config seconds, 0 uses the default
+func keepaliveConfig(interval, timeout int) (time.Duration, time.Duration, error) {
+	i, t := pingPeriod, pongWait
+	if interval > 0 {
+		i = time.Duration(interval) * time.Second
+	}
+	if timeout > 0 {
+		t = time.Duration(timeout) * time.Second
+	}
+	if t <= i {
+		return 0, 0, errPingTimeout
+	}
+	return i, t, nil
+}
 
-	logger.Debug("New connection created")
+func NewConnection(ws *websocket.Conn, server *Server, remoteAddr string) *connection {
+
+	logger.Debug("New connection created from ", remoteAddr)
 
 	if ws == nil {
 		panic("ws cannot be nil")
@@ -60,137 +124,389 @@ func NewConnection(ws *websocket.Conn, server *VpnServer) *connection {
 		panic("server cannot be nil")
 	}
 
-	maxId++
-	data := make(chan *Data)
+	id := int(atomic.AddInt32(&server.maxId, 1))
+
+	c := &connection{id: id, server: server, state: newStateMachine(StateConnecting), remoteAddr: remoteAddr}
+	c.state.subscribe(func(from, to State, err error) {
+		server.stateChanged(c, from, to, err)
+	})
 
-	c := &connection{maxId, ws, server, data, STATE_INIT, nil}
-	go c.writePump()
-	go c.readPump()
+	l := newLink(ws, c.dispatcher, c.linkClosed)
+	l.compress = server.compress
+	l.keepalive(server.ping, server.pingWait)
+	c.links = []*link{l}
+	l.start()
 
 	return c
 }
 
-func (c *connection) readPump() {
-	defer func() {
-		c.server.unregister <- c
-		c.ws.Close()
-	}()
+// queue packet on one of the links, the record is released when dropped
+func (c *connection) send(d *Data) bool {
+	c.linksMu.RLock()
+	defer c.linksMu.RUnlock()
+	if len(c.links) == 0 {
+		d.release()
+		return false
+	}
+	l := pickLink(c.links, d.Payload)
+	if c.sealer != nil {
+		d = c.sealer.seal(d)
+	}
+	return l.send(d)
+}
 
-	c.ws.SetReadLimit(maxMessageSize)
-	c.ws.SetPingHandler(func(string) error {
-		logger.Debug("Ping received")
-		if err := c.ws.WriteControl(websocket.PongMessage, []byte{}, time.Now().Add(writeWait)); err != nil {
-			logger.Error("Send ping error", err)
-		}
-		return nil
-	})
+// add websocket to the session, fails when the session is already closed
+func (c *connection) addLink(l *link) bool {
+	c.linksMu.Lock()
+	defer c.linksMu.Unlock()
+	if len(c.links) == 0 {
+		return false
+	}
+	c.links = append(c.links, l)
+	logger.Info("Session", c.ipAddress.IP, "has", len(c.links), "links")
+	return true
+}
 
-	for {
-		messageType, r, err := c.ws.ReadMessage()
-		if err == io.EOF {
-			c.cleanUp()
+// remove closed websocket, the session ends with the last one
+func (c *connection) linkClosed(l *link) {
+	c.linksMu.Lock()
+	found := false
+	for i, cl := range c.links {
+		if cl == l {
+			c.links = append(c.links[:i], c.links[i+1:]...)
+			found = true
 			break
-		} else if err != nil {
-			logger.Info(err)
-			c.cleanUp()
-			break
-		} else {
+		}
+	}
+	l.shutdown()
+	n := len(c.links)
+	c.linksMu.Unlock()
 
-			if messageType == websocket.TextMessage {
-				c.dispatcher(r)
-			}
+	if found && n == 0 {
+		c.setState(StateClosed, l.err)
+		select {
+		case c.server.unregister <- c:
+		case <-c.server.done:
 		}
 	}
 }
 
-func (c *connection) writePump() {
+// describe the session for server callbacks
+func (c *connection) info() ClientInfo {
+	info := ClientInfo{Identity: c.identity, RemoteAddr: c.remoteAddr}
+	if c.ipAddress != nil {
+		info.Address = c.ipAddress.IP
+	}
+	return info
+}
 
-	defer func() {
+// environment of client hook scripts
+func (c *connection) scriptEnv() []string {
+	return append(c.server.scriptEnv(),
+		"VPN_CLIENT_IP="+c.ipAddress.IP.String(),
+		"VPN_CLIENT_NAME="+c.identity,
+		"VPN_CLIENT_GROUP="+c.group,
+		"VPN_CLIENT_ADDR="+c.remoteAddr,
+	)
+}
 
-		c.ws.Close()
-	}()
+// close all websockets of the session
+func (c *connection) close() {
+	c.linksMu.RLock()
+	defer c.linksMu.RUnlock()
+	for _, l := range c.links {
+		l.ws.Close()
+	}
+}
 
-	for {
-		if c != nil {
-			select {
-			case message, ok := <-c.data:
-				// Thread can be still active after close connection
-				if message != nil {
-					logger.Debug("writePump data len: ", len(message.Payload))
-					if !ok {
-						c.write(websocket.CloseMessage, &Data{})
-						return
-					}
-					if err := c.write(websocket.TextMessage, message); err != nil {
-						logger.Error("writePump error", err)
-					}
-				} else {
-					break
-				}
+// flush queued packets until the deadline and close all websockets with
+// the reason
+func (c *connection) drain(deadline time.Time, code int, reason string) {
+	c.linksMu.RLock()
+	links := append([]*link(nil), c.links...)
+	c.linksMu.RUnlock()
+	for _, l := range links {
+		l.drain(deadline, code, reason)
+	}
+}
 
+// handle message read from the websocket, takes ownership of the record
+func (c *connection) dispatcher(l *link, d *Data) {
+	var err error
+	if reason, ok := parseError(d.Payload); ok {
+		d.release()
+		logger.Warning(c.remoteAddr, "Client error:", reason)
+		c.setState(StateClosed, errors.New(reason))
+		return
+	}
+	state := c.state.get()
+	logger.Debug("Dispatcher: ", state)
+	switch state {
+	case StateConnecting:
+		var message Data
+		err = json.Unmarshal(d.Payload, &message)
+		d.release()
+		if err == nil && message.ConnectionState != STATE_CONNECT {
+			err = errUnexpectedMessage
+		}
+		if err != nil {
+			logger.Warning(c.remoteAddr, "Bad handshake:", err)
+			c.fail(l, websocket.CloseUnsupportedData, errBadHandshake)
+			return
+		}
+		hello := message.Handshake
+		if hello == nil {
+			hello = new(Handshake)
+		}
+		if hello.Session != "" {
+			c.join(l, hello.Session)
+			return
+		}
+
+		c.setState(StateAuthenticating, nil)
+		if err := c.handshake(l, hello); err != nil {
+			logger.Warning(c.remoteAddr, c.identity, err)
+			c.fail(l, websocket.ClosePolicyViolation, err)
+		}
+	case StateEstablished:
+		if c.sealer != nil {
+			if d, err = c.sealer.open(d); err != nil {
+				logger.Debug(c.remoteAddr, err)
+				return
 			}
-		} else {
-			break
 		}
+		p := d.Payload
+		if !c.server.acl.allowed(p, c, DIR_UP) {
+			d.release()
+			return
+		}
+		c.limitUp.wait(len(p))
+		c.account(len(p))
+		if c.server.switchPacket(c, d) {
+			return
+		}
+		c.server.sendIface(d)
+	default:
+		d.release()
 	}
 }
 
-func (c *connection) write(mt int, message *Data) error {
+// answer the hello, assign an address and register the client
+func (c *connection) handshake(l *link, hello *Handshake) error {
+	var err error
 
-	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	c.identity = hello.Name
+	if id, ok := c.server.cfg.Identity[c.identity]; ok && c.identity != "" {
+		if id.Key != "" {
+			if err := c.authenticate(id.Key, hello); err != nil {
+				return err
+			}
+			// any client can send the name, only a proven key gets the group
+			c.group = id.Group
+		}
+	}
+	if err := c.applyLimits(); err != nil {
+		return err
+	}
 
-	if message.ConnectionState == STATE_CONNECTED {
-		err := c.ws.WriteMessage(mt, message.Payload)
-		if err != nil {
-			return err
+	d := new(Data)
+	d.ConnectionState = STATE_CONNECT
+	d.Handshake = new(Handshake)
+	if len(hello.Key) > 0 {
+		if c.server.key == nil {
+			return errNoEncryption
 		}
-	} else {
-		s, err := json.Marshal(message)
+		c.sealer, d.Handshake.Key, err = serverHandshake(c.server.key, hello)
 		if err != nil {
-			logger.Panic(err)
 			return err
 		}
+	} else if c.server.cfg.RequireEncryption {
+		return errNeedsEncrypt
+	}
+	if c.server.cfg.Batch && hello.Batch {
+		c.batch = true
+		c.batchDelay = time.Duration(c.server.cfg.BatchDelay) * time.Millisecond
+		d.Handshake.Batch = true
+		l.batcher = newBatcher(c.batchDelay)
+	}
+	c.session = newSessionToken()
+	d.Handshake.Session = c.session
+	if c.server.dns != nil {
+		d.Handshake.Dns = []string{c.server.ipnet.IP.String()}
+		d.Handshake.DnsDomain = c.server.dns.name()
+	}
 
-		err = c.ws.WriteMessage(mt, s)
-		if err != nil {
-			return err
-		}
+	cltIP, err := c.server.ippool.next()
+	if err != nil {
+		return err
+	}
+	logger.Debug("Next IP from ippool", cltIP)
+	c.ipAddress = cltIP
+	err = runScript("client-connect", c.server.cfg.ClientConnect, c.scriptEnv, c.server.scriptWait())
+	if err != nil {
+		logger.Warning(c.remoteAddr, err)
+		c.ipAddress = nil
+		c.server.ippool.relase(cltIP.IP)
+		return errRejectedByScript
 	}
+	d.Payload = []byte(cltIP.String())
+	if c.sealer != nil {
+		d.Handshake.Confirm = c.sealer.confirm(handshakeTranscript(hello, d.Handshake, d.Payload))
+	}
+	// reply goes first, packets are queued once registered
+	l.data <- d
+	select {
+	case c.server.register <- c:
+	case <-c.server.done:
+		c.server.scriptDisconnect(c)
+		c.ipAddress = nil
+		c.server.ippool.relase(cltIP.IP)
+		return errShuttingDown
+	}
+	c.setState(StateEstablished, nil)
 	return nil
 }
 
-func (c *connection) dispatcher(p []byte) {
-	logger.Debug("Dispatcher: ", c.state)
-	switch c.state {
-	case STATE_INIT:
-		logger.Debug("STATE_INIT")
-		var message Data
-		if err := json.Unmarshal(p, &message); err != nil {
-			logger.Panic(err)
-		}
-		if message.ConnectionState == STATE_CONNECT {
-			d := new(Data)
-			d.ConnectionState = STATE_CONNECT
-			cltIP, err := c.server.ippool.next()
-			if err != nil {
-				c.cleanUp()
-				logger.Error(err)
-			}
-			logger.Debug("Next IP from ippool", cltIP)
-			c.ipAddress = cltIP
-			d.Payload = []byte(cltIP.String())
-			c.state = STATE_CONNECTED
-			c.server.register <- c
-			c.data <- d
+// move to the state, invalid transitions are logged and ignored
+func (c *connection) setState(state State, cause error) {
+	if err := c.state.transition(state, cause); err != nil {
+		logger.Warning(c.remoteAddr, err)
+	}
+}
+
+// close the session on a link which failed, the client gets an error frame
+func (c *connection) fail(l *link, code int, err error) {
+	c.setState(StateClosed, err)
+	l.fail(code, err)
+}
+
+// move websocket of this new connection to an existing session
+func (c *connection) join(l *link, token string) {
+	session, ok := c.server.session(token)
+	if !ok {
+		logger.Warning(c.remoteAddr, errUnknownSession)
+		c.fail(l, websocket.ClosePolicyViolation, errUnknownSession)
+		return
+	}
+
+	reply := &Data{
+		ConnectionState: STATE_CONNECT,
+		Payload:         []byte(session.ipAddress.String()),
+		Handshake:       &Handshake{Session: token, Batch: session.batch},
+	}
+	if session.batch {
+		l.batcher = newBatcher(session.batchDelay)
+	}
+
+	c.links = nil
+	l.dispatch = session.dispatcher
+	l.closed = session.linkClosed
+	l.send(reply)
+	if !session.addLink(l) {
+		l.fail(websocket.ClosePolicyViolation, errUnknownSession)
+	}
+}
+
+func newSessionToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		logger.Panic(err)
+	}
+	return hex.EncodeToString(b)
+}
 
+// set rate limits and quota of the connection from server config
+func (c *connection) applyLimits() error {
+	limits := c.server.limits(c.identity)
+	c.quota = limits.Quota * 1024 * 1024
+	c.quotaAction = limits.QuotaAction
+	c.quotaRate = limits.QuotaRate
+	c.limitUp = newTokenBucket(limits.RateUp)
+	c.limitDown = newTokenBucket(limits.RateDown)
+
+	if c.quota > 0 && c.server.quotas.used(c.quotaKey()) >= c.quota {
+		if c.quotaAction != "throttle" {
+			return errQuotaExceeded
 		}
-	case STATE_CONNECTED:
-		logger.Debug("STATE_CONNECTED")
-		c.server.toIface <- p
+		atomic.StoreInt32(&c.overQuota, 1)
+		c.throttle()
+	}
+	return nil
+}
+
+// check the proof of a name reserved with an identity key
+func (c *connection) authenticate(key string, hello *Handshake) error {
+	if c.server.key == nil || len(hello.Key) == 0 {
+		return errNeedsEncrypt
+	}
+	public, err := decodeKey(key)
+	if err != nil {
+		return err
+	}
+	proof, err := identityProof(c.server.key.private, public, hello.Key, hello.Name)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(proof, hello.Proof) {
+		return errBadProof
+	}
+	c.authenticated = true
+	return nil
+}
+
+// key of the transfer counter. Names are chosen by the client, so only
+// authenticated identities are counted by name, others by address.
+func (c *connection) quotaKey() string {
+	if c.authenticated {
+		return c.identity
+	}
+	return c.remoteAddr
+}
+
+// count transferred bytes and enforce the monthly quota. Bytes go to the
+// shared store in chunks, its lock is not taken for every packet.
+func (c *connection) account(n int) {
+	if c.quota == 0 && !c.server.quotas.persistent() {
+		return
+	}
+	if atomic.AddInt64(&c.unaccounted, int64(n)) < quotaChunk {
+		return
+	}
+	total := c.flushQuota()
+	if c.quota == 0 || total < c.quota {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&c.overQuota, 0, 1) {
+		return
+	}
+	logger.Warning("Quota exceeded:", c.quotaKey())
+	if c.quotaAction == "throttle" {
+		c.throttle()
+	} else {
+		go c.reject(errQuotaExceeded)
 	}
 }
 
-func (c *connection) cleanUp() {
-	c.server.unregister <- c
-	c.ws.Close()
+// add the counted bytes to the quota store and return the monthly total
+func (c *connection) flushQuota() int64 {
+	return c.server.quotas.add(c.quotaKey(), atomic.SwapInt64(&c.unaccounted, 0))
+}
+
+func (c *connection) throttle() {
+	if c.quotaRate <= 0 {
+		return
+	}
+	c.limitUp.setRate(c.quotaRate)
+	c.limitDown.setRate(c.quotaRate)
+}
+
+// close all websockets telling the client why
+func (c *connection) reject(err error) {
+	c.setState(StateClosed, err)
+	c.linksMu.RLock()
+	links := append([]*link(nil), c.links...)
+	c.linksMu.RUnlock()
+	for _, l := range links {
+		l.fail(websocket.ClosePolicyViolation, err)
+	}
 }
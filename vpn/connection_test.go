@@ -0,0 +1,124 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	. "github.com/zreigz/ws-vpn/vpn/utils"
+)
+
+// wait until the session is carried by n links
+func waitLinks(t *testing.T, c *connection, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.linksMu.RLock()
+		got := len(c.links)
+		c.linksMu.RUnlock()
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("session has %d links, want %d", got, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// read the next packet from the websocket
+func readTestPacket(t *testing.T, ws *websocket.Conn) []byte {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, p, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestSessionLinks(t *testing.T) {
+	srv, url := testServer(t, ServerConfig{})
+	first, reply := testDial(t, url, &Handshake{Name: "alice"})
+	if reply.Handshake == nil || reply.Handshake.Session == "" {
+		t.Fatalf("reply %+v has no session", reply)
+	}
+	token := reply.Handshake.Session
+	second, joined := testDial(t, url, &Handshake{Session: token})
+	if joined.ConnectionState != STATE_CONNECT || string(joined.Payload) != string(reply.Payload) {
+		t.Fatalf("join reply %+v, want address %s", joined, reply.Payload)
+	}
+	c, ok := srv.session(token)
+	if !ok {
+		t.Fatal("session not registered")
+	}
+	waitLinks(t, c, 2)
+
+	// one flow for each link, every flow stays on its link
+	c.linksMu.RLock()
+	links := append([]*link(nil), c.links...)
+	c.linksMu.RUnlock()
+	flows := make(map[*link][]byte)
+	for port := 1000; len(flows) < 2; port++ {
+		p := testPacket("10.1.1.1", "10.1.1.3", 6, port, 80)
+		if _, ok := flows[pickLink(links, p)]; !ok {
+			flows[pickLink(links, p)] = p
+		}
+	}
+	for _, p := range flows {
+		d := newPacket()
+		d.Payload = append(d.Payload[:0], p...)
+		if !c.send(d) {
+			t.Fatal("packet not queued")
+		}
+	}
+	a, b := readTestPacket(t, first), readTestPacket(t, second)
+	if bytes.Equal(a, b) {
+		t.Error("both links got the same flow")
+	}
+	for _, p := range [][]byte{a, b} {
+		if !bytes.Equal(p, flows[links[0]]) && !bytes.Equal(p, flows[links[1]]) {
+			t.Errorf("unexpected packet %x", p)
+		}
+	}
+
+	// the session survives the loss of a link
+	first.Close()
+	waitLinks(t, c, 1)
+	if _, ok := srv.session(token); !ok {
+		t.Fatal("session removed with one link left")
+	}
+	p := testPacket("10.1.1.1", "10.1.1.3", 17, 53, 53)
+	d := newPacket()
+	d.Payload = append(d.Payload[:0], p...)
+	c.send(d)
+	if got := readTestPacket(t, second); !bytes.Equal(got, p) {
+		t.Errorf("remaining link got %x, want %x", got, p)
+	}
+}
+
+func TestJoinUnknownSession(t *testing.T) {
+	_, url := testServer(t, ServerConfig{})
+	_, reply := testDial(t, url, &Handshake{Session: "unknown"})
+	if reply.ConnectionState != STATE_ERROR || reply.Error != errUnknownSession.Error() {
+		t.Errorf("reply %+v, want %v", reply, errUnknownSession)
+	}
+}
@@ -0,0 +1,331 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// End-to-end payload encryption independent of TLS. The client sends an
+// ephemeral X25519 key in the handshake, the server answers with its own
+// ephemeral key. Session keys are derived from DH(ephemeral, ephemeral) and
+// DH(client ephemeral, server static), so only the holder of the pinned
+// server key can complete the handshake. Every packet is sealed with
+// ChaCha20-Poly1305 and prefixed with its 64-bit counter. The hello of the
+// client is bound into the keys, the whole handshake including the reply
+// and the assigned address into the key confirmation.
+
+const (
+	sealCounterSize = 8
+	sealOverhead    = sealCounterSize + chacha20poly1305.Overhead
+	replayWindow    = 1024
+)
+
+var (
+	invalidKey       = errors.New("Invalid key")
+	errKeyMismatch   = errors.New("Server key doesn't match the pinned key")
+	errSealedPacket  = errors.New("Invalid sealed packet")
+	errReplay        = errors.New("Replayed packet")
+	errNoEncryption  = errors.New("Encryption not supported by the peer")
+	errNeedsEncrypt  = errors.New("Encryption required")
+	errBadProof      = errors.New("Client key doesn't match the identity")
+	confirmPlaintext = []byte("ws-vpn")
+)
+
+// generate X25519 key pair, base64 encoded
+func GenerateKey() (private, public string, err error) {
+	priv := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand.Reader, priv); err != nil {
+		return "", "", err
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(priv), base64.StdEncoding.EncodeToString(pub), nil
+}
+
+func decodeKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != curve25519.ScalarSize {
+		return nil, invalidKey
+	}
+	return key, nil
+}
+
+type keyPair struct {
+	private []byte
+	public  []byte
+}
+
+func newKeyPair(private []byte) (*keyPair, error) {
+	if private == nil {
+		private = make([]byte, curve25519.ScalarSize)
+		if _, err := io.ReadFull(rand.Reader, private); err != nil {
+			return nil, err
+		}
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &keyPair{private, public}, nil
+}
+
+// hash of the handshake messages, every field except the confirmation is
+// length prefixed so that no two transcripts encode the same
+func handshakeTranscript(hello, reply *Handshake, address []byte) []byte {
+	h := sha256.New()
+	field := func(b []byte) {
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(b)))
+		h.Write(n[:])
+		h.Write(b)
+	}
+	message := func(hs *Handshake) {
+		batch := []byte{0}
+		if hs.Batch {
+			batch[0] = 1
+		}
+		field([]byte(hs.Name))
+		field(batch)
+		field([]byte(hs.Session))
+		field(hs.Key)
+		field(hs.Proof)
+		field(make([]byte, len(hs.Dns)))
+		for _, server := range hs.Dns {
+			field([]byte(server))
+		}
+		field([]byte(hs.DnsDomain))
+	}
+	message(hello)
+	if reply != nil {
+		message(reply)
+		field(address)
+	}
+	return h.Sum(nil)
+}
+
+// derive client-to-server and server-to-client keys, bound to the hello
+func deriveKeys(ee, es, clientEph, serverEph, serverStatic, hello []byte) (c2s, s2c []byte, err error) {
+	transcript := sha256.New()
+	transcript.Write(clientEph)
+	transcript.Write(serverEph)
+	transcript.Write(serverStatic)
+
+	secret := append(append([]byte{}, ee...), es...)
+	info := append([]byte("ws-vpn e2e"), hello...)
+	kdf := hkdf.New(sha256.New, secret, transcript.Sum(nil), info)
+	c2s = make([]byte, chacha20poly1305.KeySize)
+	s2c = make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(kdf, c2s); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.ReadFull(kdf, s2c); err != nil {
+		return nil, nil, err
+	}
+	return c2s, s2c, nil
+}
+
+// server side of the key exchange, returns sealer and ephemeral key, the
+// reply is confirmed once complete
+func serverHandshake(static *keyPair, hello *Handshake) (*sealer, []byte, error) {
+	eph, err := newKeyPair(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	ee, err := curve25519.X25519(eph.private, hello.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	es, err := curve25519.X25519(static.private, hello.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	c2s, s2c, err := deriveKeys(ee, es, hello.Key, eph.public, static.public, handshakeTranscript(hello, nil, nil))
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := newSealer(s2c, c2s)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, eph.public, nil
+}
+
+// client side of the key exchange, checks key confirmation of the server
+// over the hello, the reply and the assigned address
+func clientHandshake(eph *keyPair, serverStatic []byte, hello, reply *Handshake, address []byte) (*sealer, error) {
+	ee, err := curve25519.X25519(eph.private, reply.Key)
+	if err != nil {
+		return nil, err
+	}
+	es, err := curve25519.X25519(eph.private, serverStatic)
+	if err != nil {
+		return nil, err
+	}
+	c2s, s2c, err := deriveKeys(ee, es, eph.public, reply.Key, serverStatic, handshakeTranscript(hello, nil, nil))
+	if err != nil {
+		return nil, err
+	}
+	s, err := newSealer(c2s, s2c)
+	if err != nil {
+		return nil, err
+	}
+	if !s.checkConfirm(reply.Confirm, handshakeTranscript(hello, reply, address)) {
+		return nil, errKeyMismatch
+	}
+	return s, nil
+}
+
+// proof that the client holds the private key of its identity, a MAC of
+// the ephemeral key and the name keyed with DH(client static, server static)
+func identityProof(private, peer, ephemeral []byte, name string) ([]byte, error) {
+	ss, err := curve25519.X25519(private, peer)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, ss)
+	mac.Write(ephemeral)
+	mac.Write([]byte(name))
+	return mac.Sum(nil), nil
+}
+
+// seals sent packets and opens received ones
+type sealer struct {
+	// counter first, keeps it 64-bit aligned for atomic access
+	sendCounter uint64
+
+	send cipher.AEAD
+	recv cipher.AEAD
+
+	// sliding window of received counters
+	mu      sync.Mutex
+	highest uint64
+	seen    [replayWindow / 64]uint64
+}
+
+func newSealer(sendKey, recvKey []byte) (*sealer, error) {
+	send, err := chacha20poly1305.New(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := chacha20poly1305.New(recvKey)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{send: send, recv: recv}, nil
+}
+
+func counterNonce(counter uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+// key confirmation of the handshake transcript, sealed with the reserved
+// last counter of the server key
+func (s *sealer) confirm(transcript []byte) []byte {
+	return s.send.Seal(nil, counterNonce(^uint64(0)), confirmPlaintext, transcript)
+}
+
+func (s *sealer) checkConfirm(confirm, transcript []byte) bool {
+	p, err := s.recv.Open(nil, counterNonce(^uint64(0)), confirm, transcript)
+	return err == nil && subtle.ConstantTimeCompare(p, confirmPlaintext) == 1
+}
+
+// seal packet into a new record and release the original
+func (s *sealer) seal(d *Data) *Data {
+	counter := atomic.AddUint64(&s.sendCounter, 1)
+	out := newPacket()
+	if len(d.Payload)+sealOverhead > len(out.buf) {
+		out.release()
+		out = &Data{ConnectionState: STATE_CONNECTED}
+		out.Payload = make([]byte, sealCounterSize, len(d.Payload)+sealOverhead)
+		binary.BigEndian.PutUint64(out.Payload, counter)
+		out.Payload = s.send.Seal(out.Payload, counterNonce(counter), d.Payload, nil)
+		d.release()
+		return out
+	}
+	binary.BigEndian.PutUint64(out.buf, counter)
+	sealed := s.send.Seal(out.buf[sealCounterSize:sealCounterSize], counterNonce(counter), d.Payload, nil)
+	out.Payload = out.buf[:sealCounterSize+len(sealed)]
+	d.release()
+	return out
+}
+
+// open packet into a new record and release the original
+func (s *sealer) open(d *Data) (*Data, error) {
+	defer d.release()
+	p := d.Payload
+	if len(p) < sealOverhead || len(p)-sealOverhead > IFACE_BUFSIZE {
+		return nil, errSealedPacket
+	}
+	counter := binary.BigEndian.Uint64(p)
+	out := newPacket()
+	opened, err := s.recv.Open(out.buf[:0], counterNonce(counter), p[sealCounterSize:], nil)
+	if err != nil {
+		out.release()
+		return nil, errSealedPacket
+	}
+	if !s.accept(counter) {
+		out.release()
+		return nil, errReplay
+	}
+	out.Payload = opened
+	return out, nil
+}
+
+// check counter against the replay window and mark it as seen
+func (s *sealer) accept(counter uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if counter == 0 || counter == ^uint64(0) {
+		return false
+	}
+	if counter > s.highest {
+		// slide window, clear words between the old and the new highest
+		for c := s.highest/64 + 1; c <= counter/64 && c <= s.highest/64+uint64(len(s.seen)); c++ {
+			s.seen[c%uint64(len(s.seen))] = 0
+		}
+		s.highest = counter
+	} else if s.highest-counter >= replayWindow-64 {
+		return false
+	}
+	word := &s.seen[(counter/64)%uint64(len(s.seen))]
+	bit := uint64(1) << (counter % 64)
+	if *word&bit != 0 {
+		return false
+	}
+	*word |= bit
+	return true
+}
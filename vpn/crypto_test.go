@@ -0,0 +1,219 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"bytes"
+	"testing"
+)
+
+// run the key exchange, mutate changes the reply or the address in transit
+func sealerPair(t *testing.T, mutate func(hello, reply *Handshake, address []byte) []byte) (client, server *sealer, err error) {
+	static, err := newKeyPair(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eph, err := newKeyPair(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := &Handshake{Name: "alice", Batch: true, Key: eph.public}
+	server, key, err := serverHandshake(static, hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := &Handshake{Key: key, Session: "token", Dns: []string{"10.1.1.1"}, DnsDomain: "vpn"}
+	address := []byte("10.1.1.2/24")
+	reply.Confirm = server.confirm(handshakeTranscript(hello, reply, address))
+	if mutate != nil {
+		address = mutate(hello, reply, address)
+	}
+	client, err = clientHandshake(eph, static.public, hello, reply, address)
+	return client, server, err
+}
+
+func sealPacket(s *sealer, payload []byte) *Data {
+	d := newPacket()
+	d.Payload = append(d.buf[:0], payload...)
+	return s.seal(d)
+}
+
+func TestSealOpen(t *testing.T) {
+	client, server, err := sealerPair(t, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, 1400, IFACE_BUFSIZE} {
+		payload := bytes.Repeat([]byte{0x5a}, size)
+		d, err := server.open(sealPacket(client, payload))
+		if err != nil {
+			t.Fatalf("open of %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(d.Payload, payload) {
+			t.Errorf("open of %d bytes returned other payload", size)
+		}
+		d.release()
+	}
+	d, err := client.open(sealPacket(server, []byte("reply")))
+	if err != nil || string(d.Payload) != "reply" {
+		t.Errorf("server to client: %q, %v", d.Payload, err)
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	client, server, err := sealerPair(t, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := sealPacket(client, []byte("packet"))
+	tampered := append([]byte{}, sealed.Payload...)
+	tampered[len(tampered)-1] ^= 1
+	counter := append([]byte{}, sealed.Payload...)
+	counter[sealCounterSize-1]++
+
+	tests := []struct {
+		name    string
+		payload []byte
+		want    error
+	}{
+		{"short", sealed.Payload[:sealOverhead-1], errSealedPacket},
+		{"tampered", tampered, errSealedPacket},
+		{"other counter", counter, errSealedPacket},
+		{"own direction", sealPacket(server, []byte("packet")).Payload, errSealedPacket},
+		{"valid", sealed.Payload, nil},
+		{"replayed", sealed.Payload, errReplay},
+	}
+	for _, tt := range tests {
+		d, err := server.open(&Data{Payload: tt.payload})
+		if err != tt.want {
+			t.Errorf("%s: open = %v, want %v", tt.name, err, tt.want)
+		}
+		d.release()
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var s sealer
+	tests := []struct {
+		counter uint64
+		want    bool
+	}{
+		{1, true},
+		{1, false},
+		{3, true},
+		{2, true},
+		{2, false},
+		// reserved for nothing and for key confirmation
+		{0, false},
+		{^uint64(0), false},
+		// reuses the word of counters 1 to 63, cleared by the jump
+		{1025, true},
+		{1025, false},
+		{3, false},
+		{2000, true},
+		{2000 - (replayWindow - 64) + 1, true},
+		{2000 - (replayWindow - 64), false},
+		{1999, true},
+	}
+	for _, tt := range tests {
+		if got := s.accept(tt.counter); got != tt.want {
+			t.Errorf("accept(%d) = %v, want %v", tt.counter, got, tt.want)
+		}
+	}
+}
+
+func TestHandshakeTranscript(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(hello, reply *Handshake, address []byte) []byte
+	}{
+		{"session", func(hello, reply *Handshake, address []byte) []byte {
+			reply.Session = "other"
+			return address
+		}},
+		{"address", func(hello, reply *Handshake, address []byte) []byte {
+			return []byte("10.1.1.3/24")
+		}},
+		{"dns server", func(hello, reply *Handshake, address []byte) []byte {
+			reply.Dns = []string{"192.0.2.1"}
+			return address
+		}},
+		{"dns domain", func(hello, reply *Handshake, address []byte) []byte {
+			reply.DnsDomain = "vpn\nnameserver 192.0.2.1"
+			return address
+		}},
+		{"batch", func(hello, reply *Handshake, address []byte) []byte {
+			reply.Batch = true
+			return address
+		}},
+		{"hello name", func(hello, reply *Handshake, address []byte) []byte {
+			hello.Name = "mallory"
+			return address
+		}},
+		{"confirm", func(hello, reply *Handshake, address []byte) []byte {
+			reply.Confirm[0] ^= 1
+			return address
+		}},
+	}
+	for _, tt := range tests {
+		if _, _, err := sealerPair(t, tt.mutate); err != errKeyMismatch {
+			t.Errorf("changed %s: handshake = %v, want %v", tt.name, err, errKeyMismatch)
+		}
+	}
+	if _, _, err := sealerPair(t, nil); err != nil {
+		t.Errorf("unchanged handshake: %v", err)
+	}
+}
+
+func TestTranscriptFieldBoundaries(t *testing.T) {
+	a := handshakeTranscript(&Handshake{Name: "ab", Session: "c"}, nil, nil)
+	b := handshakeTranscript(&Handshake{Name: "a", Session: "bc"}, nil, nil)
+	if bytes.Equal(a, b) {
+		t.Error("fields moved across a boundary give the same transcript")
+	}
+	a = handshakeTranscript(&Handshake{Dns: []string{"a", "b"}}, nil, nil)
+	b = handshakeTranscript(&Handshake{Dns: []string{"a"}, DnsDomain: "b"}, nil, nil)
+	if bytes.Equal(a, b) {
+		t.Error("dns list and domain give the same transcript")
+	}
+}
+
+func TestIdentityProof(t *testing.T) {
+	server, _ := newKeyPair(nil)
+	client, _ := newKeyPair(nil)
+	other, _ := newKeyPair(nil)
+	eph := []byte("ephemeral")
+
+	sent, err := identityProof(client.private, server.public, eph, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the server computes the same key from its side
+	want, _ := identityProof(server.private, client.public, eph, "alice")
+	if !bytes.Equal(sent, want) {
+		t.Error("proof of the client key doesn't verify")
+	}
+	forged, _ := identityProof(other.private, server.public, eph, "alice")
+	if bytes.Equal(forged, want) {
+		t.Error("proof of another key verifies")
+	}
+	renamed, _ := identityProof(client.private, server.public, eph, "bob")
+	if bytes.Equal(renamed, want) {
+		t.Error("proof verifies for another name")
+	}
+}
@@ -17,7 +17,45 @@
  */
 package vpn
 
+import "encoding/json"
+
 type Data struct {
-	ConnectionState int    `json:"connectionState"`
-	Payload         []byte `json:"payload"`
+	ConnectionState int        `json:"connectionState"`
+	Payload         []byte     `json:"payload"`
+	Handshake       *Handshake `json:"handshake,omitempty"`
+	Error           string     `json:"error,omitempty"` // reason of STATE_ERROR
+
+	// backing buffer of pooled packet records, see packetPool
+	buf []byte
+}
+
+// return reason of an error frame, packets never start with '{'
+func parseError(p []byte) (string, bool) {
+	if len(p) == 0 || p[0] != '{' {
+		return "", false
+	}
+	var message Data
+	if json.Unmarshal(p, &message) != nil || message.ConnectionState != STATE_ERROR {
+		return "", false
+	}
+	return message.Error, true
+}
+
+// Handshake carries session parameters exchanged in STATE_CONNECT
+type Handshake struct {
+	// client identity
+	Name string `json:"name,omitempty"`
+	// coalesce packets into frames, see batcher
+	Batch bool `json:"batch,omitempty"`
+	// session token, sent by the server and used to join more websockets
+	Session string `json:"session,omitempty"`
+	// ephemeral X25519 key for payload encryption
+	Key []byte `json:"key,omitempty"`
+	// client key proof for a name reserved with an identity key
+	Proof []byte `json:"proof,omitempty"`
+	// key confirmation sent by the server
+	Confirm []byte `json:"confirm,omitempty"`
+	// resolver of client names pushed by the server and its domain
+	Dns       []string `json:"dns,omitempty"`
+	DnsDomain string   `json:"dnsDomain,omitempty"`
 }
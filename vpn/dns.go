@@ -0,0 +1,205 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	resolvConf = "/etc/resolv.conf"
+	// original resolv.conf, file or symlink, while the client replaced it
+	resolvBackup = resolvConf + ".ws-vpn"
+	resolvedDir  = "/run/systemd/resolve"
+)
+
+// DNS settings of the tunnel, restored when the client stops
+type dnsConfig struct {
+	iface string
+	// configured per link in systemd-resolved, otherwise resolv.conf
+	resolved bool
+	// resolv.conf replaced, the original is in resolvBackup
+	replaced bool
+}
+
+// check resolver addresses
+func parseDns(servers []string) error {
+	for _, server := range servers {
+		if net.ParseIP(server) == nil {
+			return fmt.Errorf("Invalid DNS server %q", server)
+		}
+	}
+	return nil
+}
+
+// check domain name, dot separated labels of letters, digits and hyphens.
+// Pushed domains end up in resolver configuration, nothing else may pass.
+func parseDomain(domain string) error {
+	name := strings.TrimSuffix(domain, ".")
+	if name == "" || len(name) > 253 {
+		return fmt.Errorf("Invalid DNS domain %q", domain)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("Invalid DNS domain %q", domain)
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return fmt.Errorf("Invalid DNS domain %q", domain)
+			}
+		}
+	}
+	return nil
+}
+
+// send DNS queries to the servers through the interface. With domains only
+// names in them use the tunnel (split DNS), otherwise all queries do.
+// Without systemd-resolved resolv.conf is replaced when fallback is set,
+// otherwise nothing is changed and nil is returned.
+func setupDns(iface string, servers, domains []string, fallback bool) (*dnsConfig, error) {
+	d := &dnsConfig{iface: iface}
+	if _, err := os.Stat(resolvedDir); err == nil {
+		if _, err := exec.LookPath("resolvectl"); err == nil {
+			d.resolved = true
+			if err := d.setupResolved(servers, domains); err != nil {
+				d.restore()
+				return nil, err
+			}
+			return d, nil
+		}
+	}
+
+	if !fallback {
+		logger.Info("systemd-resolved not running, DNS settings not changed")
+		return nil, nil
+	}
+	if len(domains) > 0 {
+		logger.Warning("Split DNS needs systemd-resolved, all queries use the tunnel")
+	}
+	// backup left by a client which didn't stop cleanly
+	if err := RestoreDns(); err != nil {
+		return nil, err
+	}
+	if err := replaceResolvConf(servers); err != nil {
+		return nil, err
+	}
+	d.replaced = true
+	return d, nil
+}
+
+// keep the original resolv.conf on disk, so it survives a crash, and write
+// one with the servers. A symlink, as set up by resolved or resolvconf, is
+// kept as link and not as a copy of its target.
+func replaceResolvConf(servers []string) error {
+	fi, err := os.Lstat(resolvConf)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(resolvConf)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, resolvBackup); err != nil {
+			return err
+		}
+	} else {
+		backup, err := ioutil.ReadFile(resolvConf)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(resolvBackup, backup, fi.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+
+	var conf bytes.Buffer
+	fmt.Fprintf(&conf, "# generated by ws-vpn, restored when it stops\n")
+	for _, server := range servers {
+		fmt.Fprintf(&conf, "nameserver %s\n", server)
+	}
+	// written next to it and renamed, writing through a link would change
+	// the file it points to
+	tmp := resolvConf + ".ws-vpn.tmp"
+	logger.Info("Writing", resolvConf)
+	if err := ioutil.WriteFile(tmp, conf.Bytes(), 0644); err != nil {
+		os.Remove(resolvBackup)
+		return err
+	}
+	if err := os.Rename(tmp, resolvConf); err != nil {
+		os.Remove(tmp)
+		os.Remove(resolvBackup)
+		return err
+	}
+	return nil
+}
+
+// RestoreDns puts back resolv.conf replaced by the client, it does nothing
+// when there is no backup
+func RestoreDns() error {
+	if _, err := os.Lstat(resolvBackup); os.IsNotExist(err) {
+		return nil
+	}
+	logger.Info("Restoring", resolvConf)
+	return os.Rename(resolvBackup, resolvConf)
+}
+
+func (d *dnsConfig) setupResolved(servers, domains []string) error {
+	routing := []string{"~."}
+	defaultRoute := "true"
+	if len(domains) > 0 {
+		routing = routing[:0]
+		for _, domain := range domains {
+			routing = append(routing, "~"+strings.TrimPrefix(domain, "~"))
+		}
+		defaultRoute = "false"
+	}
+	if err := resolvectl(append([]string{"dns", d.iface}, servers...)...); err != nil {
+		return err
+	}
+	if err := resolvectl(append([]string{"domain", d.iface}, routing...)...); err != nil {
+		return err
+	}
+	return resolvectl("default-route", d.iface, defaultRoute)
+}
+
+// restore DNS settings of the host
+func (d *dnsConfig) restore() error {
+	if d.resolved {
+		return resolvectl("revert", d.iface)
+	}
+	if !d.replaced {
+		return nil
+	}
+	return RestoreDns()
+}
+
+func resolvectl(args ...string) error {
+	logger.Info("resolvectl", strings.Join(args, " "))
+	out, err := exec.Command("resolvectl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("resolvectl: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// default domain of client names
+	DNS_DOMAIN = "vpn"
+
+	dnsTimeout = 5 * time.Second
+	dnsTTL     = 60
+	dnsBufSize = 4096
+)
+
+var errNoUpstream = errors.New("No upstream DNS server")
+
+// resolver on the tunnel address answering <name>.vpn with the address of
+// the client with the name and forwarding other queries upstream
+type dnsServer struct {
+	server *Server
+	conn   *net.UDPConn
+	// lower case with trailing dot
+	domain   string
+	upstream []string
+}
+
+func newDnsServer(server *Server, domain string, upstream []string) *dnsServer {
+	if domain == "" {
+		domain = DNS_DOMAIN
+	}
+	d := &dnsServer{server: server, domain: strings.ToLower(strings.Trim(domain, ".")) + "."}
+	if len(upstream) == 0 {
+		upstream = systemResolvers()
+	}
+	for _, up := range upstream {
+		if _, _, err := net.SplitHostPort(up); err != nil {
+			up = net.JoinHostPort(up, "53")
+		}
+		d.upstream = append(d.upstream, up)
+	}
+	return d
+}
+
+// nameservers of the host, the server itself keeps using them
+func systemResolvers() []string {
+	f, err := os.Open(resolvConf)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+// domain pushed to clients
+func (d *dnsServer) name() string {
+	return strings.TrimSuffix(d.domain, ".")
+}
+
+// listen on port 53 of the address
+func (d *dnsServer) start(ip net.IP) error {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip, Port: 53})
+	if err != nil {
+		return err
+	}
+	d.conn = conn
+	logger.Info("DNS server listening on", conn.LocalAddr(), "for", d.domain)
+	go d.serve()
+	return nil
+}
+
+func (d *dnsServer) close() {
+	if d.conn != nil {
+		d.conn.Close()
+	}
+}
+
+func (d *dnsServer) serve() {
+	buf := make([]byte, dnsBufSize)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			logger.Debug("DNS server:", err)
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go d.handle(query, addr)
+	}
+}
+
+func (d *dnsServer) handle(query []byte, addr *net.UDPAddr) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		logger.Debug("DNS query from", addr, err)
+		return
+	}
+	question, err := parser.Question()
+	if err != nil {
+		logger.Debug("DNS query from", addr, err)
+		return
+	}
+
+	var reply []byte
+	name := strings.ToLower(question.Name.String())
+	if name == d.domain || strings.HasSuffix(name, "."+d.domain) {
+		reply, err = d.answer(header, question, strings.TrimSuffix(name, d.domain))
+	} else {
+		reply, err = d.forward(header.ID, query)
+	}
+	if err != nil {
+		logger.Debug("DNS", name, err)
+		return
+	}
+	d.conn.WriteToUDP(reply, addr)
+}
+
+// answer query for a client name, label is the name without the domain
+func (d *dnsServer) answer(query dnsmessage.Header, question dnsmessage.Question, label string) ([]byte, error) {
+	ip, ok := d.server.lookupName(strings.TrimSuffix(label, "."))
+	header := dnsmessage.Header{
+		ID:               query.ID,
+		Response:         true,
+		Authoritative:    true,
+		RecursionDesired: query.RecursionDesired,
+		RCode:            dnsmessage.RCodeSuccess,
+	}
+	if !ok {
+		header.RCode = dnsmessage.RCodeNameError
+	}
+
+	b := dnsmessage.NewBuilder(nil, header)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(question); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	if ip4 := ip.To4(); ok && ip4 != nil && question.Type == dnsmessage.TypeA {
+		rh := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: dnsTTL}
+		var a dnsmessage.AResource
+		copy(a.A[:], ip4)
+		if err := b.AResource(rh, a); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// send query to upstream resolvers in order and return the first answer
+func (d *dnsServer) forward(id uint16, query []byte) ([]byte, error) {
+	err := errNoUpstream
+	buf := make([]byte, dnsBufSize)
+	for _, up := range d.upstream {
+		var conn net.Conn
+		conn, err = net.DialTimeout("udp", up, dnsTimeout)
+		if err != nil {
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(dnsTimeout))
+		var n int
+		if _, err = conn.Write(query); err == nil {
+			n, err = conn.Read(buf)
+		}
+		conn.Close()
+		if err != nil {
+			continue
+		}
+		if n < 2 || uint16(buf[0])<<8|uint16(buf[1]) != id {
+			err = errors.New("Mismatched DNS reply")
+			continue
+		}
+		return buf[:n], nil
+	}
+	return nil, err
+}
@@ -0,0 +1,135 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// server with registered clients, identities prefixed with * proved a key
+func serverWithClients(identities ...string) *Server {
+	srv := &Server{clients: make(map[string]*connection)}
+	for i, identity := range identities {
+		ip := net.IPv4(10, 1, 1, byte(i+2))
+		c := &connection{identity: strings.TrimPrefix(identity, "*"), ipAddress: &net.IPNet{IP: ip}}
+		c.authenticated = strings.HasPrefix(identity, "*")
+		srv.clients[ip.String()] = c
+	}
+	return srv
+}
+
+func TestParseDomain(t *testing.T) {
+	tests := []struct {
+		domain string
+		valid  bool
+	}{
+		{"vpn", true},
+		{"vpn.example.com", true},
+		{"vpn.example.com.", true},
+		{"Corp-1.lan", true},
+		{"", false},
+		{".", false},
+		{"vpn..com", false},
+		{"-vpn", false},
+		{"vpn-", false},
+		{"vpn\nnameserver 192.0.2.1", false},
+		{"vpn com", false},
+		{"~vpn", false},
+		{strings.Repeat("a", 63), true},
+		{strings.Repeat("a", 64), false},
+		{strings.Repeat("a.", 126) + "a", true},
+		{strings.Repeat("a.", 126) + "ab", false},
+	}
+	for _, tt := range tests {
+		if err := parseDomain(tt.domain); (err == nil) != tt.valid {
+			t.Errorf("parseDomain(%q) = %v, want valid %v", tt.domain, err, tt.valid)
+		}
+	}
+}
+
+func TestLookupName(t *testing.T) {
+	tests := []struct {
+		name    string
+		clients []string
+		lookup  string
+		want    net.IP
+	}{
+		{"unique", []string{"alice", "bob"}, "alice", net.IPv4(10, 1, 1, 2)},
+		{"case insensitive", []string{"alice"}, "ALICE", net.IPv4(10, 1, 1, 2)},
+		{"unknown", []string{"alice"}, "carol", nil},
+		{"empty", []string{""}, "", nil},
+		{"duplicate", []string{"alice", "alice"}, "alice", nil},
+		{"authenticated wins", []string{"alice", "*alice", "alice"}, "alice", net.IPv4(10, 1, 1, 3)},
+		{"two authenticated", []string{"*alice", "*alice"}, "alice", nil},
+	}
+	for _, tt := range tests {
+		srv := serverWithClients(tt.clients...)
+		ip, ok := srv.lookupName(tt.lookup)
+		if ok != (tt.want != nil) || !ip.Equal(tt.want) {
+			t.Errorf("%s: lookupName(%q) = %v, %v, want %v", tt.name, tt.lookup, ip, ok, tt.want)
+		}
+	}
+}
+
+func TestDnsAnswer(t *testing.T) {
+	d := newDnsServer(serverWithClients("alice"), "vpn", []string{"192.0.2.53"})
+	tests := []struct {
+		name    string
+		qtype   dnsmessage.Type
+		rcode   dnsmessage.RCode
+		answers int
+	}{
+		{"alice.vpn.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 1},
+		{"alice.vpn.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, 0},
+		{"bob.vpn.", dnsmessage.TypeA, dnsmessage.RCodeNameError, 0},
+		{"vpn.", dnsmessage.TypeA, dnsmessage.RCodeNameError, 0},
+	}
+	for _, tt := range tests {
+		question := dnsmessage.Question{
+			Name:  dnsmessage.MustNewName(tt.name),
+			Type:  tt.qtype,
+			Class: dnsmessage.ClassINET,
+		}
+		query := dnsmessage.Header{ID: 7, RecursionDesired: true}
+		reply, err := d.answer(query, question, strings.TrimSuffix(tt.name, d.domain))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(reply); err != nil {
+			t.Fatal(err)
+		}
+		if msg.ID != 7 || !msg.Response || !msg.Authoritative || !msg.RecursionDesired {
+			t.Errorf("%s %v: header %+v", tt.name, tt.qtype, msg.Header)
+		}
+		if msg.RCode != tt.rcode || len(msg.Answers) != tt.answers {
+			t.Errorf("%s %v: %v with %d answers, want %v with %d", tt.name, tt.qtype, msg.RCode, len(msg.Answers), tt.rcode, tt.answers)
+			continue
+		}
+		if tt.answers > 0 {
+			a, ok := msg.Answers[0].Body.(*dnsmessage.AResource)
+			if !ok || !net.IP(a.A[:]).Equal(net.IPv4(10, 1, 1, 2)) || msg.Answers[0].Header.TTL != dnsTTL {
+				t.Errorf("%s: answer %v", tt.name, msg.Answers[0])
+			}
+		}
+	}
+}
@@ -0,0 +1,126 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const probeTimeout = 5 * time.Second
+
+// server the client can connect to, lower priority is preferred
+type endpoint struct {
+	host     string
+	port     int
+	priority int
+}
+
+func (e endpoint) addr() string {
+	return net.JoinHostPort(e.host, strconv.Itoa(e.port))
+}
+
+func (e endpoint) url(path string) string {
+	u := url.URL{Scheme: "ws", Host: e.addr(), Path: path}
+	return u.String()
+}
+
+// parse endpoint entry "host:port [priority]"
+func parseEndpoint(entry string) (endpoint, error) {
+	var e endpoint
+	fields := strings.Fields(entry)
+	if len(fields) == 0 || len(fields) > 2 {
+		return e, fmt.Errorf("Invalid endpoint %q", entry)
+	}
+	host, port, err := net.SplitHostPort(fields[0])
+	if err != nil {
+		return e, fmt.Errorf("Invalid endpoint %q: %v", entry, err)
+	}
+	// bypass routes and the kill switch are IPv4 only
+	if ip := net.ParseIP(host); ip == nil || ip.To4() == nil {
+		return e, fmt.Errorf("Endpoint %q needs an IPv4 address", entry)
+	}
+	e.host = host
+	if e.port, err = strconv.Atoi(port); err != nil {
+		return e, fmt.Errorf("Invalid endpoint %q: %v", entry, err)
+	}
+	if len(fields) == 2 {
+		if e.priority, err = strconv.Atoi(fields[1]); err != nil {
+			return e, fmt.Errorf("Invalid endpoint %q: %v", entry, err)
+		}
+	}
+	return e, nil
+}
+
+// measure TCP connect time to the endpoint. A websocket would be taken
+// for a client by the server, a connection closed before any request isn't.
+func probe(e endpoint) (time.Duration, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", e.addr(), probeTimeout)
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	conn.Close()
+	return rtt, nil
+}
+
+// probe endpoints and return the reachable ones ordered by priority and
+// latency
+func rankEndpoints(endpoints []endpoint) []endpoint {
+	type result struct {
+		e   endpoint
+		rtt time.Duration
+		err error
+	}
+	results := make(chan result, len(endpoints))
+	for _, e := range endpoints {
+		go func(e endpoint) {
+			rtt, err := probe(e)
+			results <- result{e, rtt, err}
+		}(e)
+	}
+
+	var reachable []result
+	for range endpoints {
+		r := <-results
+		if r.err != nil {
+			logger.Info("Endpoint", r.e.addr(), "unreachable:", r.err)
+			continue
+		}
+		logger.Info("Endpoint", r.e.addr(), "priority", r.e.priority, "latency", r.rtt)
+		reachable = append(reachable, r)
+	}
+	sort.Slice(reachable, func(i, j int) bool {
+		if reachable[i].e.priority != reachable[j].e.priority {
+			return reachable[i].e.priority < reachable[j].e.priority
+		}
+		return reachable[i].rtt < reachable[j].rtt
+	})
+
+	ranked := make([]endpoint, len(reachable))
+	for i, r := range reachable {
+		ranked[i] = r.e
+	}
+	return ranked
+}
@@ -0,0 +1,92 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	tests := []struct {
+		entry string
+		want  endpoint
+		valid bool
+	}{
+		{"10.0.0.1:80", endpoint{"10.0.0.1", 80, 0}, true},
+		{"10.0.0.1:443 20", endpoint{"10.0.0.1", 443, 20}, true},
+		{"  10.0.0.1:443   -1 ", endpoint{"10.0.0.1", 443, -1}, true},
+		{"", endpoint{}, false},
+		{"10.0.0.1", endpoint{}, false},
+		{"10.0.0.1:http", endpoint{}, false},
+		{"10.0.0.1:80 high", endpoint{}, false},
+		{"10.0.0.1:80 1 2", endpoint{}, false},
+		{"vpn.example.com:80", endpoint{}, false},
+		{"[2001:db8::1]:80", endpoint{}, false},
+		{"[::ffff:10.0.0.1]:80", endpoint{"::ffff:10.0.0.1", 80, 0}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseEndpoint(tt.entry)
+		if (err == nil) != tt.valid {
+			t.Errorf("parseEndpoint(%q) error %v, want valid %v", tt.entry, err, tt.valid)
+			continue
+		}
+		if tt.valid && got != tt.want {
+			t.Errorf("parseEndpoint(%q) = %+v, want %+v", tt.entry, got, tt.want)
+		}
+	}
+}
+
+// endpoint of a loopback listener accepting connections
+func listeningEndpoint(t *testing.T, priority int) endpoint {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return endpoint{host, p, priority}
+}
+
+func TestRankEndpoints(t *testing.T) {
+	// a closed listener leaves a port nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	closed := endpoint{"127.0.0.1", l.Addr().(*net.TCPAddr).Port, 0}
+
+	backup := listeningEndpoint(t, 20)
+	primary := listeningEndpoint(t, 10)
+	ranked := rankEndpoints([]endpoint{backup, closed, primary})
+	if len(ranked) != 2 || ranked[0] != primary || ranked[1] != backup {
+		t.Errorf("rankEndpoints = %+v, want %+v then %+v", ranked, primary, backup)
+	}
+}
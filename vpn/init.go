@@ -21,16 +21,25 @@ import loging "github.com/zreigz/ws-vpn/vpn/utils"
 
 var logger = loging.GetLogger()
 
-var MTU = 1400
-
 const (
+	DEFAULT_MTU = 1400
+
+	// kbit/s of clients throttled for exceeding their quota
+	DEFAULT_QUOTA_RATE = 128
+
 	IFACE_BUFSIZE = 2000
+
+	WS_PATH = "/ws"
 )
 
+// connectionState of messages on the wire, sessions use State
 const (
 	STATE_INIT = 0
 
 	STATE_CONNECT = 1
 
 	STATE_CONNECTED = 2
+
+	// error frame sent before closing the websocket
+	STATE_ERROR = 3
 )
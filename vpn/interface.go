@@ -22,6 +22,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/exec"
@@ -33,39 +34,72 @@ import (
 
 var invalidAddr = errors.New("Invalid device ip address")
 
-var tun_peer net.IP
-
-func newTun(name string) (iface *water.Interface, err error) {
+// packet device of the tunnel, a tun interface or the userspace stack
+type device interface {
+	io.ReadWriteCloser
+	Name() string
+}
 
-	iface, err = water.New(water.Config{})
+func newTun(name string, mtu int) (iface *water.Interface, err error) {
+	queues, err := newTunQueues(name, 1, mtu)
 	if err != nil {
 		return nil, err
 	}
+	return queues[0], nil
+}
+
+// create tun interface with n queues, every queue has its own file
+// descriptor and more than one sets IFF_MULTI_QUEUE
+func newTunQueues(name string, n, mtu int) (queues []*water.Interface, err error) {
+	if n < 1 {
+		n = 1
+	}
+	cfg := water.Config{DeviceType: water.TUN}
+	cfg.Name = name
+	cfg.MultiQueue = n > 1
+
+	for i := 0; i < n; i++ {
+		queue, err := water.New(cfg)
+		if err != nil {
+			for _, q := range queues {
+				q.Close()
+			}
+			return nil, err
+		}
+		// attach other queues to the same interface
+		cfg.Name = queue.Name()
+		queues = append(queues, queue)
+	}
+	iface := queues[0]
 	logger.Info("interface %v created", iface.Name())
 
-	sargs := fmt.Sprintf("link set dev %s up mtu %d qlen 100", iface.Name(), MTU)
+	sargs := fmt.Sprintf("link set dev %s up mtu %d qlen 100", iface.Name(), mtu)
 	args := strings.Split(sargs, " ")
 	cmd := exec.Command("ip", args...)
 	logger.Info("ip %s", sargs)
 	err = cmd.Run()
 	if err != nil {
+		for _, q := range queues {
+			q.Close()
+		}
 		return nil, err
 	}
 
-	return iface, nil
+	return queues, nil
 }
 
-func setTunIP(iface *water.Interface, ip net.IP, subnet *net.IPNet) (err error) {
+// assign address to the interface and route the subnet via the peer
+// address, which is returned
+func setTunIP(iface device, ip net.IP, subnet *net.IPNet) (peer net.IP, err error) {
 	ip = ip.To4()
 	logger.Debug("IP address ", ip)
-	if ip[3]%2 == 0 {
-		return invalidAddr
+	if ip == nil || ip[3]%2 == 0 {
+		return nil, invalidAddr
 	}
 
-	peer := net.IP(make([]byte, 4))
+	peer = net.IP(make([]byte, 4))
 	copy([]byte(peer), []byte(ip))
 	peer[3]++
-	tun_peer = peer
 
 	sargs := fmt.Sprintf("addr add dev %s local %s peer %s", iface.Name(), ip, peer)
 	args := strings.Split(sargs, " ")
@@ -73,15 +107,24 @@ func setTunIP(iface *water.Interface, ip net.IP, subnet *net.IPNet) (err error)
 	logger.Info("ip ", sargs)
 	err = cmd.Run()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	sargs = fmt.Sprintf("route add %s via %s dev %s", subnet, peer, iface.Name())
 	args = strings.Split(sargs, " ")
 	cmd = exec.Command("ip", args...)
 	logger.Info("ip ", sargs)
-	err = cmd.Run()
-	return err
+	if err = cmd.Run(); err != nil {
+		return nil, err
+	}
+	return peer, nil
+}
+
+// remove all addresses of the interface
+func flushTunIP(iface device) error {
+	sargs := fmt.Sprintf("addr flush dev %s", iface.Name())
+	logger.Info("ip ", sargs)
+	return exec.Command("ip", strings.Split(sargs, " ")...).Run()
 }
 
 // return net gateway (default route) and nic
@@ -155,7 +198,7 @@ func addRoute(dest, nextHop, iface string) {
 }
 
 // delete route
-func delRoute(dest string) {
+func delRoute(dest string) error {
 	sargs := fmt.Sprintf("-4 route del %s", dest)
 	args := strings.Split(sargs, " ")
 	cmd := exec.Command("ip", args...)
@@ -165,13 +208,16 @@ func delRoute(dest string) {
 	if err != nil {
 		logger.Warning(err.Error())
 	}
+	return err
 }
 
+// routes covering everything but more specific than the default route
+var redirectRoutes = []string{"0.0.0.0/1", "128.0.0.0/1"}
+
 // redirect default gateway
 func redirectGateway(iface, gw string) error {
-	subnets := []string{"0.0.0.0/1", "128.0.0.0/1"}
 	logger.Info("Redirecting Gateway")
-	for _, subnet := range subnets {
+	for _, subnet := range redirectRoutes {
 		sargs := fmt.Sprintf("-4 route add %s via %s dev %s", subnet, gw, iface)
 		args := strings.Split(sargs, " ")
 		cmd := exec.Command("ip", args...)
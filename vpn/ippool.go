@@ -25,24 +25,51 @@ import (
 
 type VpnIpPool struct {
 	subnet *net.IPNet
-	pool   [127]int32
+	pool   [256]int32
+	// shared leases of a cluster, nil on a single server
+	cluster *cluster
 }
 
+// pool slot states
+const (
+	ipFree int32 = iota
+	ipUsed
+	// leased by another cluster node
+	ipRemote
+)
+
 var poolFull = errors.New("IP Pool Full")
 
 func (p *VpnIpPool) next() (*net.IPNet, error) {
 	found := false
 	var i int
 	for i = 3; i < 255; i += 2 {
-		if atomic.CompareAndSwapInt32(&p.pool[i], 0, 1) {
+		if !atomic.CompareAndSwapInt32(&p.pool[i], ipFree, ipUsed) {
+			continue
+		}
+		if p.cluster == nil {
+			found = true
+			break
+		}
+		ok, err := p.cluster.acquire(p.addr(i).IP)
+		if err != nil {
+			atomic.StoreInt32(&p.pool[i], ipFree)
+			return nil, err
+		}
+		if ok {
 			found = true
 			break
 		}
+		atomic.StoreInt32(&p.pool[i], ipRemote)
 	}
 	if !found {
 		return nil, poolFull
 	}
 
+	return p.addr(i), nil
+}
+
+func (p *VpnIpPool) addr(i int) *net.IPNet {
 	ipnet := &net.IPNet{
 		make([]byte, 4),
 		make([]byte, 4),
@@ -50,7 +77,7 @@ func (p *VpnIpPool) next() (*net.IPNet, error) {
 	copy([]byte(ipnet.IP), []byte(p.subnet.IP))
 	copy([]byte(ipnet.Mask), []byte(p.subnet.Mask))
 	ipnet.IP[3] = byte(i)
-	return ipnet, nil
+	return ipnet
 }
 
 func (p *VpnIpPool) relase(ip net.IP) {
@@ -62,5 +89,22 @@ func (p *VpnIpPool) relase(ip net.IP) {
 
 	logger.Debug("releasing ip: ", ip)
 	i := ip[3]
-	p.pool[i] = 0
+	atomic.StoreInt32(&p.pool[i], ipFree)
+	if p.cluster != nil {
+		p.cluster.release(ip)
+	}
+}
+
+// mark an address of a client on another node as taken
+func (p *VpnIpPool) hold(ip net.IP) {
+	if ip = ip.To4(); ip != nil && p.subnet.Contains(ip) {
+		atomic.CompareAndSwapInt32(&p.pool[ip[3]], ipFree, ipRemote)
+	}
+}
+
+// free an address once the other node released it
+func (p *VpnIpPool) unhold(ip net.IP) {
+	if ip = ip.To4(); ip != nil && p.subnet.Contains(ip) {
+		atomic.CompareAndSwapInt32(&p.pool[ip[3]], ipRemote, ipFree)
+	}
 }
@@ -0,0 +1,92 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+)
+
+const killSwitchTable = "ws_vpn_killswitch"
+
+// nftables rules dropping all outgoing traffic except to the VPN server and
+// through the tunnel, so nothing leaks when the tunnel is down
+type killSwitch struct {
+	iface string
+}
+
+// install rules allowing only loopback, the tun interface and TCP to the
+// servers (host:port), replacing rules left by a previous run
+func setupKillSwitch(iface string, servers []string) (*killSwitch, error) {
+	k := &killSwitch{iface: iface}
+	if err := k.update(servers); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// replace the rules for a new list of servers
+func (k *killSwitch) update(servers []string) error {
+	var rules bytes.Buffer
+	fmt.Fprintf(&rules, "table inet %s\n", killSwitchTable)
+	fmt.Fprintf(&rules, "delete table inet %s\n", killSwitchTable)
+	fmt.Fprintf(&rules, "table inet %s {\n", killSwitchTable)
+	fmt.Fprintf(&rules, "\tchain output {\n")
+	fmt.Fprintf(&rules, "\t\ttype filter hook output priority 0; policy drop;\n")
+	fmt.Fprintf(&rules, "\t\toifname \"lo\" accept\n")
+	fmt.Fprintf(&rules, "\t\toifname %q accept\n", k.iface)
+	for _, server := range servers {
+		host, port, err := net.SplitHostPort(server)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return fmt.Errorf("Kill switch needs server address, got %q", host)
+		}
+		family := "ip"
+		if ip.To4() == nil {
+			family = "ip6"
+		}
+		fmt.Fprintf(&rules, "\t\t%s daddr %s tcp dport %s accept\n", family, ip, port)
+	}
+	fmt.Fprintf(&rules, "\t}\n}\n")
+
+	logger.Info("Kill switch enabled for", k.iface)
+	return nft(rules.String())
+}
+
+// RemoveKillSwitch removes the kill switch rules, the client keeps them
+// when it stops because the connection was lost
+func RemoveKillSwitch() error {
+	logger.Info("Kill switch disabled")
+	return nft(fmt.Sprintf("table inet %s\ndelete table inet %s\n", killSwitchTable, killSwitchTable))
+}
+
+// run nft with the rules on stdin
+func nft(rules string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = bytes.NewBufferString(rules)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nft: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Single websocket of a session. A session can be carried by several links,
+// packets are striped over them by flow hash so every flow keeps its order.
+type link struct {
+	ws   *websocket.Conn
+	data chan *Data
+	// sends take the read lock, closing data the write lock, so a
+	// session holding a stale copy of its links can't send on a closed link
+	dataMu sync.RWMutex
+	shut   bool
+	// packet batching, nil when not negotiated
+	batcher *batcher
+	// ping period, 0 sends no pings
+	ping time.Duration
+	// link is dead when nothing arrives for this long, 0 never times out
+	timeout time.Duration
+
+	// handles every message read, replaced when the link joins a session
+	dispatch func(l *link, d *Data)
+	// called once when the link is closed
+	closed func(l *link)
+	// error which ended the read loop, a close error sent by the peer
+	err error
+	// compress messages when permessage-deflate is negotiated
+	compress bool
+	// samples whether messages shrink, created by the writer
+	deflate *compressor
+}
+
+func newLink(ws *websocket.Conn, dispatch func(*link, *Data), closed func(*link)) *link {
+	ws.SetReadLimit(maxMessageSize)
+	return &link{
+		ws:       ws,
+		data:     make(chan *Data, 100),
+		dispatch: dispatch,
+		closed:   closed,
+	}
+}
+
+// send pings every interval and close the link when the peer stays silent
+// for timeout
+func (l *link) keepalive(interval, timeout time.Duration) {
+	l.ping = interval
+	l.timeout = timeout
+	l.ws.SetPingHandler(func(data string) error {
+		l.alive()
+		logger.Debug("Ping received")
+		err := l.ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeWait))
+		if err != nil && err != websocket.ErrCloseSent {
+			logger.Error("Send pong error", err)
+		}
+		return nil
+	})
+	l.ws.SetPongHandler(func(string) error {
+		l.alive()
+		logger.Debug("Pong received")
+		return nil
+	})
+}
+
+// extend the read deadline, the peer is alive
+func (l *link) alive() {
+	if l.timeout > 0 {
+		l.ws.SetReadDeadline(time.Now().Add(l.timeout))
+	}
+}
+
+func (l *link) start() {
+	l.alive()
+	go l.writePump()
+	go l.readPump()
+}
+
+// queue message without blocking, the record is released when the queue
+// is full or the link closed
+func (l *link) send(d *Data) bool {
+	l.dataMu.RLock()
+	defer l.dataMu.RUnlock()
+	if l.shut {
+		d.release()
+		return false
+	}
+	select {
+	case l.data <- d:
+		return true
+	default:
+		d.release()
+		return false
+	}
+}
+
+// close the queue, the writer sends a close frame and stops
+func (l *link) shutdown() {
+	l.dataMu.Lock()
+	defer l.dataMu.Unlock()
+	if !l.shut {
+		l.shut = true
+		close(l.data)
+	}
+}
+
+func (l *link) readPump() {
+	defer func() {
+		l.ws.Close()
+		l.closed(l)
+	}()
+
+	for {
+		messageType, d, err := readPacket(l.ws)
+		if err == io.EOF {
+			break
+		} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			logger.Warning("No keepalive from peer", l.ws.RemoteAddr(), "for", l.timeout)
+			l.err = err
+			break
+		} else if err != nil {
+			logger.Info(err)
+			l.err = err
+			break
+		}
+		l.alive()
+
+		if messageType == websocket.TextMessage {
+			l.dispatch(l, d)
+		} else if messageType == websocket.BinaryMessage && l.batcher != nil {
+			if err := unbatch(d.Payload, func(p *Data) { l.dispatch(l, p) }); err != nil {
+				logger.Warning(err)
+			}
+			d.release()
+		} else {
+			d.release()
+		}
+	}
+
+	if l.batcher != nil {
+		logger.Info(fmt.Sprintf("Batching: %.1f packets per frame", l.batcher.ratio()))
+	}
+}
+
+func (l *link) writePump() {
+	var ping <-chan time.Time
+	if l.ping > 0 {
+		ticker := time.NewTicker(l.ping)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	defer l.ws.Close()
+	defer func() {
+		if l.deflate != nil {
+			logger.Info(fmt.Sprintf("Compression: %.2f of sampled bytes, %d messages sent uncompressed",
+				l.deflate.ratio(), l.deflate.skipped))
+		}
+	}()
+
+	for {
+		select {
+		case message, ok := <-l.data:
+			if !ok {
+				msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+				l.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+				return
+			}
+			for message != nil {
+				logger.Debug("writePump data len: ", len(message.Payload))
+				message = l.writeNext(message)
+			}
+		case <-ping:
+			if err := l.ws.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait)); err != nil {
+				logger.Error("Send ping error", err)
+			}
+		}
+	}
+}
+
+// write message, or a frame of packets when batching, and return the next
+// message which has to be written
+func (l *link) writeNext(message *Data) *Data {
+	// control messages don't look at the batcher, the handshake sets it
+	// while the hello may still be written
+	if message.ConnectionState == STATE_CONNECTED && l.batcher != nil {
+		frame, next := l.batcher.collect(message, l.data)
+		l.ws.SetWriteDeadline(time.Now().Add(writeWait))
+		l.compressNext(frame)
+		if err := l.ws.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+			logger.Error("writePump error", err)
+		}
+		return next
+	}
+	if err := l.write(message); err != nil {
+		logger.Error("writePump error", err)
+	}
+	message.release()
+	return nil
+}
+
+func (l *link) write(message *Data) error {
+
+	l.ws.SetWriteDeadline(time.Now().Add(writeWait))
+
+	if message.ConnectionState == STATE_CONNECTED {
+		l.compressNext(message.Payload)
+		return l.ws.WriteMessage(websocket.TextMessage, message.Payload)
+	}
+	l.ws.EnableWriteCompression(false)
+	s, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return l.ws.WriteMessage(websocket.TextMessage, s)
+}
+
+// compress the next message when enabled and it pays off
+func (l *link) compressNext(p []byte) {
+	compress := false
+	if l.compress {
+		if l.deflate == nil {
+			l.deflate = newCompressor()
+		}
+		compress = l.deflate.worth(p)
+	}
+	l.ws.EnableWriteCompression(compress)
+}
+
+// close the websocket telling the peer why
+func (l *link) reject(code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	l.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+	l.ws.Close()
+}
+
+// send an error frame and close the websocket with the error as reason
+func (l *link) fail(code int, err error) {
+	l.send(&Data{ConnectionState: STATE_ERROR, Error: err.Error()})
+	l.drain(time.Now().Add(writeWait), code, err.Error())
+}
+
+// wait until queued messages are written or the deadline passes, then
+// close the websocket telling the peer why
+func (l *link) drain(deadline time.Time, code int, reason string) {
+	for len(l.data) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	l.reject(code, reason)
+}
+
+// pick link for the packet by flow hash
+func pickLink(links []*link, p []byte) *link {
+	if len(links) == 1 {
+		return links[0]
+	}
+	return links[flowHash(p)%uint32(len(links))]
+}
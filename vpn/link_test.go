@@ -0,0 +1,46 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRejectClosedLink(t *testing.T) {
+	client, ws := wsPair(t)
+	defer client.Close()
+	srv := &Server{unregister: make(chan *connection), done: make(chan struct{})}
+	close(srv.done)
+	c := &connection{server: srv, state: newStateMachine(StateEstablished)}
+	l := newLink(ws, c.dispatcher, c.linkClosed)
+	c.links = []*link{l}
+
+	// reject copied the links, then the read loop of the link ended
+	links := append([]*link(nil), c.links...)
+	c.linkClosed(l)
+	for _, l := range links {
+		l.fail(websocket.ClosePolicyViolation, errQuotaExceeded)
+	}
+	if l.send(newPacket()) {
+		t.Error("packet queued on a closed link")
+	}
+	c.reject(errQuotaExceeded)
+	c.linkClosed(l)
+}
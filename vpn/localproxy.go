@@ -0,0 +1,245 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+)
+
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+var socksUnsupported = errors.New("Unsupported SOCKS request")
+
+// connections which can stop sending and keep receiving
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// copy data both ways. The end of one direction is passed on as a half
+// close, both connections are closed when both directions are done or a
+// copy fails.
+func pipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn) {
+		defer func() { done <- struct{}{} }()
+		if _, err := io.Copy(dst, src); err != nil {
+			a.Close()
+			b.Close()
+			return
+		}
+		if cw, ok := dst.(closeWriter); ok && cw.CloseWrite() == nil {
+			return
+		}
+		// no half close, the other direction can't finish either
+		a.Close()
+		b.Close()
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+	<-done
+	a.Close()
+	b.Close()
+}
+
+// SOCKS5 proxy (no authentication, CONNECT only) dialing through the tunnel
+func serveSocks(addr string, dial dialFunc) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("SOCKS5 proxy listening on", addr)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				logger.Debug(err)
+				return
+			}
+			go func() {
+				if err := socksConnect(conn, dial); err != nil {
+					logger.Debug("SOCKS:", err)
+					conn.Close()
+				}
+			}()
+		}
+	}()
+	return l, nil
+}
+
+func socksConnect(conn net.Conn, dial dialFunc) error {
+	// greeting: version, number of methods, methods
+	buf := make([]byte, 262)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != 5 {
+		return socksUnsupported
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return err
+	}
+
+	// request: version, command, reserved, address type
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return err
+	}
+	if buf[1] != 1 {
+		conn.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+		return socksUnsupported
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+			return err
+		}
+		host = net.IP(buf[:4]).String()
+	case 3:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		n := int(buf[0])
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return err
+		}
+		host = string(buf[:n])
+	default:
+		conn.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
+		return socksUnsupported
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+
+	remote, err := dial(context.Background(), "tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return err
+	}
+	if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		remote.Close()
+		return err
+	}
+	pipe(conn, remote)
+	return nil
+}
+
+// HTTP proxy supporting CONNECT and plain requests, dialing through the tunnel
+func serveHttpProxy(addr string, dial dialFunc) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("HTTP proxy listening on", addr)
+
+	forward := &httputil.ReverseProxy{
+		Director:  func(r *http.Request) {},
+		Transport: &http.Transport{DialContext: dial},
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			if !r.URL.IsAbs() {
+				http.Error(w, "Proxy requests only", http.StatusBadRequest)
+				return
+			}
+			forward.ServeHTTP(w, r)
+			return
+		}
+		remote, err := dial(r.Context(), "tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			remote.Close()
+			http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+			return
+		}
+		conn, _, err := hj.Hijack()
+		if err != nil {
+			remote.Close()
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		pipe(conn, remote)
+	})
+	go func() {
+		logger.Debug(http.Serve(l, handler))
+	}()
+	return l, nil
+}
+
+// parse forward entry "127.0.0.1:5432 -> 10.1.1.1:5432"
+func parseForward(entry string) (local, remote string, err error) {
+	parts := strings.Split(entry, "->")
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("Invalid forward %q", entry)
+	}
+	local = strings.TrimSpace(parts[0])
+	remote = strings.TrimSpace(parts[1])
+	for _, addr := range []string{local, remote} {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return "", "", fmt.Errorf("Invalid forward %q: %v", entry, err)
+		}
+	}
+	return local, remote, nil
+}
+
+// accept TCP connections on local address and connect them to remote
+// address through the tunnel
+func serveForward(local, remote string, dial dialFunc) (net.Listener, error) {
+	l, err := net.Listen("tcp", local)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Forwarding", local, "->", remote)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				logger.Debug(err)
+				return
+			}
+			go func() {
+				dst, err := dial(context.Background(), "tcp", remote)
+				if err != nil {
+					logger.Warning("Forward to", remote, err)
+					conn.Close()
+					return
+				}
+				pipe(conn, dst)
+			}()
+		}
+	}()
+	return l, nil
+}
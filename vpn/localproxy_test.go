@@ -0,0 +1,99 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// accept one connection of a loopback listener
+func acceptOne(t *testing.T, l net.Listener) <-chan net.Conn {
+	ch := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			close(ch)
+			return
+		}
+		ch <- conn
+	}()
+	return ch
+}
+
+func TestPipeHalfClose(t *testing.T) {
+	front, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer front.Close()
+	back, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer back.Close()
+
+	// proxy: accept on front and pipe to back
+	go func() {
+		conn, err := front.Accept()
+		if err != nil {
+			return
+		}
+		remote, err := net.Dial("tcp", back.Addr().String())
+		if err != nil {
+			conn.Close()
+			return
+		}
+		pipe(conn, remote)
+	}()
+
+	// server answers once the request is complete
+	served := acceptOne(t, back)
+	go func() {
+		conn := <-served
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		request, err := ioutil.ReadAll(conn)
+		if err != nil {
+			return
+		}
+		conn.Write(append([]byte("re: "), request...))
+	}()
+
+	client, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte("ping"))
+	client.(*net.TCPConn).CloseWrite()
+
+	reply, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "re: ping" {
+		t.Errorf("reply after half close %q, want %q", reply, "re: ping")
+	}
+}
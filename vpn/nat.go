@@ -0,0 +1,108 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+const ipForwardFile = "/proc/sys/net/ipv4/ip_forward"
+
+// iptables rules and sysctl installed for masquerading tunnel traffic
+type nat struct {
+	rules   [][]string
+	forward string
+}
+
+// enable ip_forward and install NAT and FORWARD rules for the subnet,
+// everything is reverted by teardown
+func setupNat(iface, subnet, outIface string) (*nat, error) {
+	n := new(nat)
+
+	b, err := ioutil.ReadFile(ipForwardFile)
+	if err != nil {
+		return nil, err
+	}
+	n.forward = strings.TrimSpace(string(b))
+	if n.forward != "1" {
+		logger.Info("Enabling ip_forward")
+		if err := ioutil.WriteFile(ipForwardFile, []byte("1\n"), 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	masquerade := []string{"-t", "nat", "POSTROUTING", "-s", subnet, "!", "-d", subnet}
+	if outIface != "" {
+		masquerade = append(masquerade, "-o", outIface)
+	}
+	masquerade = append(masquerade, "-j", "MASQUERADE")
+
+	rules := [][]string{
+		masquerade,
+		{"FORWARD", "-i", iface, "-j", "ACCEPT"},
+		{"FORWARD", "-o", iface, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+	}
+	for _, rule := range rules {
+		if err := iptables("-I", rule); err != nil {
+			n.teardown()
+			return nil, err
+		}
+		n.rules = append(n.rules, rule)
+	}
+	return n, nil
+}
+
+// remove installed rules and restore ip_forward, returns the first error
+func (n *nat) teardown() error {
+	var first error
+	for i := len(n.rules) - 1; i >= 0; i-- {
+		if err := iptables("-D", n.rules[i]); err != nil {
+			logger.Warning(err.Error())
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	n.rules = nil
+
+	if n.forward != "" && n.forward != "1" {
+		logger.Info("Restoring ip_forward")
+		if err := ioutil.WriteFile(ipForwardFile, []byte(n.forward+"\n"), 0644); err != nil {
+			logger.Warning(err.Error())
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// run iptables with the operation placed after the table selection
+func iptables(op string, rule []string) error {
+	args := make([]string, 0, len(rule)+1)
+	if len(rule) > 2 && rule[0] == "-t" {
+		args = append(args, rule[:2]...)
+		rule = rule[2:]
+	}
+	args = append(args, op)
+	args = append(args, rule...)
+	logger.Info("iptables", strings.Join(args, " "))
+	return exec.Command("iptables", args...).Run()
+}
@@ -0,0 +1,158 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+const netstackNIC = 1
+
+// userspace TCP/IP stack used instead of a tun device, doesn't need root
+type netstackDevice struct {
+	stack  *stack.Stack
+	ep     *channel.Endpoint
+	ctx    context.Context
+	cancel context.CancelFunc
+	// assigned address, replaced on reconnect
+	addr tcpip.Address
+}
+
+func newNetstack(mtu int) (*netstackDevice, error) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4},
+	})
+	ep := channel.New(256, uint32(mtu), "")
+	if err := s.CreateNIC(netstackNIC, ep); err != nil {
+		return nil, errors.New(err.String())
+	}
+	// everything leaves through the tunnel
+	s.SetRouteTable([]tcpip.Route{{Destination: defaultSubnet(), NIC: netstackNIC}})
+
+	d := &netstackDevice{stack: s, ep: ep}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	return d, nil
+}
+
+func defaultSubnet() tcpip.Subnet {
+	subnet, _ := tcpip.NewSubnet(tcpip.AddrFrom4([4]byte{}), tcpip.MaskFromBytes(make([]byte, 4)))
+	return subnet
+}
+
+func (d *netstackDevice) Name() string {
+	return "netstack"
+}
+
+// read packet sent by the stack
+func (d *netstackDevice) Read(p []byte) (int, error) {
+	pkt := d.ep.ReadContext(d.ctx)
+	if pkt.IsNil() {
+		return 0, io.EOF
+	}
+	defer pkt.DecRef()
+	view := pkt.ToView()
+	defer view.Release()
+	return copy(p, view.AsSlice()), nil
+}
+
+// deliver packet received from the tunnel to the stack
+func (d *netstackDevice) Write(p []byte) (int, error) {
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(p),
+	})
+	d.ep.InjectInbound(ipv4.ProtocolNumber, pkt)
+	pkt.DecRef()
+	return len(p), nil
+}
+
+func (d *netstackDevice) Close() error {
+	d.cancel()
+	d.ep.Close()
+	d.stack.Close()
+	return nil
+}
+
+// set address assigned by the server
+func (d *netstackDevice) setIP(ip net.IP) error {
+	addr := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddrFrom4Slice(ip.To4()).WithPrefix(),
+	}
+	if d.addr.Len() > 0 {
+		if err := d.stack.RemoveAddress(netstackNIC, d.addr); err != nil {
+			return errors.New(err.String())
+		}
+	}
+	if err := d.stack.AddProtocolAddress(netstackNIC, addr, stack.AddressProperties{}); err != nil {
+		return errors.New(err.String())
+	}
+	d.addr = addr.AddressWithPrefix.Address
+	return nil
+}
+
+// dial TCP or UDP connection through the tunnel, host names are resolved
+// by the local resolver
+func (d *netstackDevice) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+		if err != nil {
+			return nil, err
+		}
+		ip = ips[0]
+	}
+	if ip.To4() == nil {
+		return nil, errors.New("Only IPv4 is supported over the tunnel")
+	}
+	addr := tcpip.FullAddress{
+		NIC:  netstackNIC,
+		Addr: tcpip.AddrFrom4Slice(ip.To4()),
+		Port: uint16(port),
+	}
+
+	switch network {
+	case "tcp", "tcp4":
+		return gonet.DialContextTCP(ctx, d.stack, addr, ipv4.ProtocolNumber)
+	case "udp", "udp4":
+		return gonet.DialUDP(d.stack, nil, &addr, ipv4.ProtocolNumber)
+	}
+	return nil, errors.New("Unsupported network " + network)
+}
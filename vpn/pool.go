@@ -0,0 +1,83 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Packets travel in pooled Data records. Whoever receives a packet record
+// from a channel owns it and must pass it on or call release: the interface
+// reader hands it to a writePump, the websocket reader to toIface, and the
+// writer at the end of the path releases it once the packet is written.
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		return &Data{buf: make([]byte, IFACE_BUFSIZE)}
+	},
+}
+
+// get packet record from the pool, Payload spans the whole buffer
+func newPacket() *Data {
+	d := packetPool.Get().(*Data)
+	d.ConnectionState = STATE_CONNECTED
+	d.Payload = d.buf
+	return d
+}
+
+// return packet record to the pool, records not taken from it are ignored
+func (d *Data) release() {
+	if d == nil || d.buf == nil {
+		return
+	}
+	d.Payload = nil
+	d.Handshake = nil
+	packetPool.Put(d)
+}
+
+// read websocket message into pooled packet record. Messages larger than
+// the packet buffer, e.g. handshake, are read into a newly allocated one.
+func readPacket(ws *websocket.Conn) (int, *Data, error) {
+	messageType, r, err := ws.NextReader()
+	if err != nil {
+		return messageType, nil, err
+	}
+	d := newPacket()
+	n, err := io.ReadFull(r, d.buf)
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		d.Payload = d.buf[:n]
+		return messageType, d, nil
+	case nil:
+		rest, err := ioutil.ReadAll(r)
+		if err != nil {
+			d.release()
+			return messageType, nil, err
+		}
+		large := &Data{ConnectionState: STATE_CONNECTED}
+		large.Payload = append(append(make([]byte, 0, n+len(rest)), d.buf...), rest...)
+		d.release()
+		return messageType, large, nil
+	default:
+		d.release()
+		return messageType, nil, err
+	}
+}
@@ -0,0 +1,183 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/op/go-logging"
+)
+
+func TestMain(m *testing.M) {
+	// debug messages of the packet path drown benchmark results
+	logging.SetLevel(logging.WARNING, "ws-vpn")
+	os.Exit(m.Run())
+}
+
+// websocket connected over loopback, returns both ends
+func wsPair(tb testing.TB) (client, server *websocket.Conn) {
+	return wsPairWith(tb, upgrader, websocket.DefaultDialer)
+}
+
+func wsPairWith(tb testing.TB, up websocket.Upgrader, dialer *websocket.Dialer) (client, server *websocket.Conn) {
+	accepted := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := up.Upgrade(w, r, nil)
+		if err != nil {
+			tb.Error(err)
+			return
+		}
+		accepted <- ws
+	}))
+	tb.Cleanup(srv.Close)
+	client, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	server = <-accepted
+	tb.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// read and drop messages until the websocket closes
+func discard(ws *websocket.Conn) {
+	for {
+		_, r, err := ws.NextReader()
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, r)
+	}
+}
+
+func TestReadPacket(t *testing.T) {
+	client, server := wsPair(t)
+	small := bytes.Repeat([]byte{1}, 100)
+	large := bytes.Repeat([]byte{2}, IFACE_BUFSIZE+100)
+	go func() {
+		server.WriteMessage(websocket.BinaryMessage, small)
+		server.WriteMessage(websocket.BinaryMessage, large)
+	}()
+
+	_, d, err := readPacket(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d.Payload, small) || d.buf == nil {
+		t.Errorf("small message: %d bytes, pooled %v", len(d.Payload), d.buf != nil)
+	}
+	d.release()
+
+	_, d, err = readPacket(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d.Payload, large) || d.buf != nil {
+		t.Errorf("large message: %d bytes, pooled %v", len(d.Payload), d.buf != nil)
+	}
+	// not from the pool, release must leave it alone
+	d.release()
+	if !bytes.Equal(d.Payload, large) {
+		t.Error("release changed a record not taken from the pool")
+	}
+}
+
+// typical packet of a full size TCP segment
+var benchPacket = bytes.Repeat([]byte{0x45}, 1400)
+
+func BenchmarkReadPacket(b *testing.B) {
+	read := map[string]func(ws *websocket.Conn) error{
+		"pooled": func(ws *websocket.Conn) error {
+			_, d, err := readPacket(ws)
+			if err == nil {
+				d.release()
+			}
+			return err
+		},
+		// before pooling every message got its own buffer
+		"alloc": func(ws *websocket.Conn) error {
+			_, p, err := ws.ReadMessage()
+			d := &Data{ConnectionState: STATE_CONNECTED, Payload: p}
+			_ = d
+			return err
+		},
+	}
+	for _, name := range []string{"alloc", "pooled"} {
+		b.Run(name, func(b *testing.B) {
+			client, server := wsPair(b)
+			go func(n int) {
+				for i := 0; i < n; i++ {
+					if server.WriteMessage(websocket.BinaryMessage, benchPacket) != nil {
+						return
+					}
+				}
+			}(b.N)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(benchPacket)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := read[name](client); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// packet read from the interface, queued and written to a websocket
+func BenchmarkSendPath(b *testing.B) {
+	packet := map[string]func() *Data{
+		"pooled": func() *Data {
+			d := newPacket()
+			d.Payload = d.buf[:copy(d.buf, benchPacket)]
+			return d
+		},
+		// before pooling every packet was read into a new buffer
+		"alloc": func() *Data {
+			buf := make([]byte, IFACE_BUFSIZE)
+			return &Data{ConnectionState: STATE_CONNECTED, Payload: buf[:copy(buf, benchPacket)]}
+		},
+	}
+	for _, name := range []string{"alloc", "pooled"} {
+		b.Run(name, func(b *testing.B) {
+			client, server := wsPair(b)
+			go discard(client)
+			l := newLink(server, nil, nil)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(benchPacket)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				l.data <- packet[name]()
+				if l.writeNext(<-l.data) != nil {
+					b.Fatal("unexpected message left")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var errProxyHeader = errors.New("proxyHeader has to be X-Forwarded-For or Forwarded")
+
+type trustedProxies struct {
+	nets []*net.IPNet
+	// header with the client chain, proxies pass the other one unchanged
+	// so a client could set it
+	header string
+}
+
+// parse list of trusted proxies, every entry is an IP or a CIDR, and the
+// header they set, X-Forwarded-For by default
+func parseTrustedProxies(list []string, header string) (trustedProxies, error) {
+	t := trustedProxies{header: http.CanonicalHeaderKey(header)}
+	switch t.header {
+	case "":
+		t.header = "X-Forwarded-For"
+	case "X-Forwarded-For", "Forwarded":
+	default:
+		return t, errProxyHeader
+	}
+	t.nets = make([]*net.IPNet, 0, len(list))
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return t, err
+		}
+		t.nets = append(t.nets, ipnet)
+	}
+	return t, nil
+}
+
+func (t trustedProxies) contains(ip net.IP) bool {
+	for _, ipnet := range t.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// return the real client address of the request. Forwarding headers are
+// only honoured when the request comes from a trusted proxy, the chain is
+// walked from the right and the first untrusted hop is the client.
+func (t trustedProxies) clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !t.contains(ip) {
+		return host
+	}
+
+	hops := forwardedFor(r.Header, t.header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHop(hops[i])
+		if hop == nil {
+			// obfuscated or broken entry, nothing behind it can be trusted
+			break
+		}
+		host = hop.String()
+		if !t.contains(hop) {
+			break
+		}
+	}
+	return host
+}
+
+// return client chain from the Forwarded or X-Forwarded-For header
+func forwardedFor(h http.Header, header string) []string {
+	hops := make([]string, 0, 4)
+	if header == "X-Forwarded-For" {
+		for _, value := range h["X-Forwarded-For"] {
+			for _, hop := range strings.Split(value, ",") {
+				hops = append(hops, hop)
+			}
+		}
+		return hops
+	}
+	for _, value := range h["Forwarded"] {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+					hops = append(hops, pair[4:])
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parse single hop: 192.0.2.1, "192.0.2.1:4711", "[2001:db8::1]:4711"
+func parseHop(hop string) net.IP {
+	hop = strings.Trim(strings.TrimSpace(hop), "\"")
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	return net.ParseIP(strings.Trim(hop, "[]"))
+}
@@ -0,0 +1,73 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientAddr(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"127.0.0.1", "10.0.0.0/8", "::1"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwarded, err := parseTrustedProxies([]string{"127.0.0.1", "10.0.0.0/8", "::1"}, "forwarded")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		trusted    trustedProxies
+		remoteAddr string
+		header     http.Header
+		want       string
+	}{
+		{"direct", trusted, "192.0.2.1:4711", nil, "192.0.2.1"},
+		{"untrusted sender", trusted, "192.0.2.1:4711", http.Header{"X-Forwarded-For": {"198.51.100.7"}}, "192.0.2.1"},
+		{"trusted proxy", trusted, "127.0.0.1:4711", http.Header{"X-Forwarded-For": {"198.51.100.7"}}, "198.51.100.7"},
+		{"trusted proxy ipv6", trusted, "[::1]:4711", http.Header{"X-Forwarded-For": {"198.51.100.7"}}, "198.51.100.7"},
+		{"chain of proxies", trusted, "127.0.0.1:4711", http.Header{"X-Forwarded-For": {"198.51.100.7, 10.1.2.3"}}, "198.51.100.7"},
+		{"spoofed left entry", trusted, "127.0.0.1:4711", http.Header{"X-Forwarded-For": {"203.0.113.9, 198.51.100.7"}}, "198.51.100.7"},
+		{"several headers", trusted, "127.0.0.1:4711", http.Header{"X-Forwarded-For": {"203.0.113.9", "198.51.100.7"}}, "198.51.100.7"},
+		// nginx appends to X-Forwarded-For and passes Forwarded of the client
+		{"injected forwarded", trusted, "127.0.0.1:4711", http.Header{"Forwarded": {"for=198.51.100.7"}, "X-Forwarded-For": {"203.0.113.9"}}, "203.0.113.9"},
+		{"injected forwarded alone", trusted, "127.0.0.1:4711", http.Header{"Forwarded": {"for=198.51.100.7"}}, "127.0.0.1"},
+		{"no header", trusted, "127.0.0.1:4711", nil, "127.0.0.1"},
+		{"forwarded", forwarded, "127.0.0.1:4711", http.Header{"Forwarded": {`for="[2001:db8::1]:80";proto=https`}}, "2001:db8::1"},
+		{"injected x-forwarded-for", forwarded, "127.0.0.1:4711", http.Header{"Forwarded": {"for=198.51.100.7"}, "X-Forwarded-For": {"203.0.113.9"}}, "198.51.100.7"},
+		{"obfuscated hop", forwarded, "127.0.0.1:4711", http.Header{"Forwarded": {"for=_hidden, for=10.1.2.3"}}, "10.1.2.3"},
+		{"forwarded untrusted sender", forwarded, "192.0.2.1:4711", http.Header{"Forwarded": {"for=198.51.100.7"}}, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		r := &http.Request{RemoteAddr: tt.remoteAddr, Header: tt.header}
+		if got := tt.trusted.clientAddr(r); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	if _, err := parseTrustedProxies([]string{"not an address"}, ""); err == nil {
+		t.Error("invalid entry accepted")
+	}
+	if _, err := parseTrustedProxies(nil, "X-Real-IP"); err != errProxyHeader {
+		t.Errorf("unknown header: %v", err)
+	}
+}
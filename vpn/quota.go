@@ -0,0 +1,126 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const quotaSaveInterval = time.Minute
+
+// monthly transfer counters per identity
+type quotaStore struct {
+	mu     sync.Mutex
+	file   string
+	Period string           `json:"period"`
+	Usage  map[string]int64 `json:"usage"`
+	dirty  bool
+}
+
+func currentPeriod() string {
+	return time.Now().Format("2006-01")
+}
+
+// load counters from file, empty file name keeps them in memory only
+func newQuotaStore(file string) (*quotaStore, error) {
+	q := &quotaStore{file: file, Period: currentPeriod(), Usage: make(map[string]int64)}
+	if file == "" {
+		return q, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return q, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, q); err != nil {
+		return nil, err
+	}
+	if q.Usage == nil {
+		q.Usage = make(map[string]int64)
+	}
+	return q, nil
+}
+
+// add n bytes to the counter and return the total for this month
+func (q *quotaStore) add(key string, n int64) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if period := currentPeriod(); period != q.Period {
+		q.Period = period
+		q.Usage = make(map[string]int64)
+	}
+	q.Usage[key] += n
+	q.dirty = true
+	return q.Usage[key]
+}
+
+// counters are kept across restarts
+func (q *quotaStore) persistent() bool {
+	return q.file != ""
+}
+
+func (q *quotaStore) used(key string) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.Period != currentPeriod() {
+		return 0
+	}
+	return q.Usage[key]
+}
+
+func (q *quotaStore) save() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.file == "" || !q.dirty {
+		return nil
+	}
+	b, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	tmp := q.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, q.file); err != nil {
+		return err
+	}
+	q.dirty = false
+	return nil
+}
+
+// save counters periodically until done is closed
+func (q *quotaStore) run(done <-chan struct{}) {
+	ticker := time.NewTicker(quotaSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := q.save(); err != nil {
+				logger.Error("Saving quota counters:", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
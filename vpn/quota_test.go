@@ -0,0 +1,98 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"path/filepath"
+	"testing"
+
+	. "github.com/zreigz/ws-vpn/vpn/utils"
+)
+
+func TestAccountChunks(t *testing.T) {
+	quotas, err := newQuotaStore(filepath.Join(t.TempDir(), "quota.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &connection{server: &Server{quotas: quotas}, remoteAddr: "192.0.2.1"}
+
+	c.account(quotaChunk - 1)
+	if used := quotas.used("192.0.2.1"); used != 0 {
+		t.Errorf("partial chunk added to the store: %d", used)
+	}
+	c.account(2)
+	if used := quotas.used("192.0.2.1"); used != quotaChunk+1 {
+		t.Errorf("store has %d bytes, want %d", used, quotaChunk+1)
+	}
+	c.account(10)
+	if total := c.flushQuota(); total != quotaChunk+11 {
+		t.Errorf("flush returned %d, want %d", total, quotaChunk+11)
+	}
+}
+
+func TestAccountUnlimited(t *testing.T) {
+	quotas, _ := newQuotaStore("")
+	c := &connection{server: &Server{quotas: quotas}, remoteAddr: "192.0.2.1"}
+	c.account(2 * quotaChunk)
+	if c.unaccounted != 0 || len(quotas.Usage) != 0 {
+		t.Errorf("counted without quota or quotaFile: %d pending, %v", c.unaccounted, quotas.Usage)
+	}
+}
+
+func TestAccountQuotaExceeded(t *testing.T) {
+	quotas, _ := newQuotaStore("")
+	c := &connection{
+		server:      &Server{quotas: quotas},
+		remoteAddr:  "192.0.2.1",
+		quota:       quotaChunk,
+		quotaAction: "throttle",
+		quotaRate:   8,
+		limitUp:     newTokenBucket(0),
+		limitDown:   newTokenBucket(0),
+	}
+	c.account(quotaChunk)
+	if c.overQuota != 1 || c.limitUp.rate == 0 {
+		t.Errorf("quota of %d bytes not enforced after %d", c.quota, quotas.used("192.0.2.1"))
+	}
+}
+
+func TestFlushQuotaOnClose(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "quota.json")
+	srv, err := NewServerWithOptions(ServerOptions{Config: ServerConfig{VpnAddr: "10.1.1.1/24", QuotaFile: file}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip, err := srv.ippool.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &connection{server: srv, ipAddress: ip, remoteAddr: "192.0.2.1"}
+	srv.clients[ip.IP.String()] = c
+	c.account(10)
+
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	quotas, err := newQuotaStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used := quotas.used("192.0.2.1"); used != 10 {
+		t.Errorf("saved %d bytes, want 10", used)
+	}
+}
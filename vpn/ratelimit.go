@@ -0,0 +1,97 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"sync"
+	"time"
+)
+
+// token bucket, rate and burst are in bytes, zero rate is unlimited
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// create bucket for rate given in kbit/s
+func newTokenBucket(kbit int) *tokenBucket {
+	b := new(tokenBucket)
+	b.setRate(kbit)
+	b.tokens = b.burst
+	return b
+}
+
+func (b *tokenBucket) setRate(kbit int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if kbit < 0 {
+		kbit = 0
+	}
+	b.rate = float64(kbit) * 1000 / 8
+	// allow a burst of 100ms but never less than a single packet
+	b.burst = b.rate / 10
+	if b.burst < IFACE_BUFSIZE {
+		b.burst = IFACE_BUFSIZE
+	}
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = time.Now()
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// take n bytes if available, used to police traffic we can't slow down
+func (b *tokenBucket) allow(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate == 0 {
+		return true
+	}
+	b.refill(time.Now())
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// take n bytes, sleep until they are available
+func (b *tokenBucket) wait(n int) {
+	b.mu.Lock()
+	if b.rate == 0 {
+		b.mu.Unlock()
+		return
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
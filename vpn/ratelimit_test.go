@@ -0,0 +1,89 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketAllow(t *testing.T) {
+	tests := []struct {
+		name string
+		kbit int
+		take []int
+		want []bool
+	}{
+		{"unlimited", 0, []int{1 << 20, 1 << 20}, []bool{true, true}},
+		{"negative is unlimited", -5, []int{1 << 20}, []bool{true}},
+		// 8 kbit/s is 1000 bytes/s, burst is at least one packet
+		{"burst of one packet", 8, []int{IFACE_BUFSIZE, 1}, []bool{true, false}},
+		{"small packets", 8, []int{1000, 1000, 1}, []bool{true, true, false}},
+		// 80 Mbit/s allows a burst of 100ms, 1 MB
+		{"burst of 100ms", 80000, []int{1000000, 1000}, []bool{true, false}},
+	}
+	for _, tt := range tests {
+		b := newTokenBucket(tt.kbit)
+		for i, n := range tt.take {
+			if got := b.allow(n); got != tt.want[i] {
+				t.Errorf("%s: allow(%d) #%d = %v, want %v", tt.name, n, i, got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	b := newTokenBucket(8)
+	if !b.allow(IFACE_BUFSIZE) {
+		t.Fatal("full bucket refused a packet")
+	}
+	b.refill(b.last.Add(500 * time.Millisecond))
+	if b.tokens < 499 || b.tokens > 501 {
+		t.Errorf("refill of 500ms at 1000 bytes/s gave %.0f tokens", b.tokens)
+	}
+	b.refill(b.last.Add(time.Hour))
+	if b.tokens != b.burst {
+		t.Errorf("tokens %.0f exceed burst %.0f", b.tokens, b.burst)
+	}
+}
+
+func TestTokenBucketSetRate(t *testing.T) {
+	b := newTokenBucket(0)
+	b.setRate(8)
+	if b.tokens > b.burst {
+		t.Errorf("tokens %.0f above the new burst %.0f", b.tokens, b.burst)
+	}
+	if b.allow(int(b.burst) + 1) {
+		t.Error("throttled bucket allowed more than its burst")
+	}
+}
+
+func TestTokenBucketWait(t *testing.T) {
+	// 80 kbit/s is 10000 bytes/s with a burst of one packet
+	b := newTokenBucket(80)
+	start := time.Now()
+	b.wait(IFACE_BUFSIZE)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("wait within the burst slept %v", elapsed)
+	}
+	start = time.Now()
+	b.wait(1000)
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("wait for 1000 bytes at 10000 bytes/s slept only %v", elapsed)
+	}
+}
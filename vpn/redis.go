@@ -0,0 +1,282 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	redisPrefix  = "ws-vpn:lease:"
+	redisTimeout = 5 * time.Second
+)
+
+var invalidReply = errors.New("Invalid redis reply")
+
+// take the key unless another node holds it, renew it otherwise
+const redisAcquire = `local v = redis.call('GET', KEYS[1])
+if v == false or v == ARGV[1] then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return 1
+end
+return 0`
+
+// delete the key only if the node holds it
+const redisRelease = `if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`
+
+// lease table in a Redis compatible store, one expiring key per address
+type redisLeases struct {
+	addr     string
+	password string
+	db       int
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func newRedisLeases(u *url.URL) (*redisLeases, error) {
+	r := &redisLeases{addr: u.Host}
+	if u.Port() == "" {
+		r.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		r.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		n, err := strconv.Atoi(db)
+		if err != nil {
+			return nil, err
+		}
+		r.db = n
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.dial(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// connect and select the database, called with mu held
+func (r *redisLeases) dial() error {
+	conn, err := net.DialTimeout("tcp", r.addr, redisTimeout)
+	if err != nil {
+		return err
+	}
+	r.conn = conn
+	r.rd = bufio.NewReader(conn)
+	if r.password != "" {
+		if _, err := r.call("AUTH", r.password); err != nil {
+			r.reset()
+			return err
+		}
+	}
+	if r.db != 0 {
+		if _, err := r.call("SELECT", strconv.Itoa(r.db)); err != nil {
+			r.reset()
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *redisLeases) reset() {
+	if r.conn != nil {
+		r.conn.Close()
+	}
+	r.conn = nil
+	r.rd = nil
+}
+
+// run a command, reconnecting after connection errors
+func (r *redisLeases) do(args ...string) (interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		if err := r.dial(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := r.call(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		r.reset()
+	}
+	return reply, err
+}
+
+// send a command and read its reply, called with mu held
+func (r *redisLeases) call(args ...string) (interface{}, error) {
+	r.conn.SetDeadline(time.Now().Add(redisTimeout))
+	buf := make([]byte, 0, 64)
+	buf = append(buf, fmt.Sprintf("*%d\r\n", len(args))...)
+	for _, arg := range args {
+		buf = append(buf, fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)...)
+	}
+	if _, err := r.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return readReply(r.rd)
+}
+
+// parse one RESP reply, nil bulk strings and arrays are returned as nil
+func readReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, invalidReply
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, invalidReply
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, b); err != nil {
+			return nil, err
+		}
+		if b[n] != '\r' || b[n+1] != '\n' {
+			return nil, invalidReply
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, invalidReply
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readReply(rd); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, invalidReply
+}
+
+func (r *redisLeases) acquire(ip, node string, ttl time.Duration) (bool, error) {
+	ms := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	reply, err := r.do("EVAL", redisAcquire, "1", redisPrefix+ip, node, ms)
+	if err != nil {
+		return false, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return false, invalidReply
+	}
+	return n == 1, nil
+}
+
+func (r *redisLeases) release(ip, node string) error {
+	_, err := r.do("EVAL", redisRelease, "1", redisPrefix+ip, node)
+	return err
+}
+
+func (r *redisLeases) leases() (map[string]string, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := r.do("SCAN", cursor, "MATCH", redisPrefix+"*", "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return nil, invalidReply
+		}
+		cursor, ok = page[0].(string)
+		found, ok2 := page[1].([]interface{})
+		if !ok || !ok2 {
+			return nil, invalidReply
+		}
+		for _, key := range found {
+			if s, ok := key.(string); ok {
+				keys = append(keys, s)
+			}
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+
+	leases := make(map[string]string, len(keys))
+	if len(keys) == 0 {
+		return leases, nil
+	}
+	reply, err := r.do(append([]string{"MGET"}, keys...)...)
+	if err != nil {
+		return nil, err
+	}
+	nodes, ok := reply.([]interface{})
+	if !ok || len(nodes) != len(keys) {
+		return nil, invalidReply
+	}
+	for i, node := range nodes {
+		// expired between SCAN and MGET
+		if s, ok := node.(string); ok {
+			leases[strings.TrimPrefix(keys[i], redisPrefix)] = s
+		}
+	}
+	return leases, nil
+}
+
+func (r *redisLeases) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		return nil
+	}
+	_, err := r.call("QUIT")
+	r.reset()
+	return err
+}
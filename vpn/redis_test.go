@@ -0,0 +1,95 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		in   string
+		want interface{}
+		err  bool
+	}{
+		{"+OK\r\n", "OK", false},
+		{"-ERR unknown command\r\n", nil, true},
+		{":1\r\n", int64(1), false},
+		{":-3\r\n", int64(-3), false},
+		{"$5\r\nnode1\r\n", "node1", false},
+		{"$0\r\n\r\n", "", false},
+		{"$-1\r\n", nil, false},
+		{"$4\r\na\r\nb\r\n", "a\r\nb", false},
+		{"*-1\r\n", nil, false},
+		{"*2\r\n$1\r\n0\r\n*2\r\n$3\r\nkey\r\n$-1\r\n", []interface{}{"0", []interface{}{"key", nil}}, false},
+		{"*0\r\n", []interface{}{}, false},
+		// malformed and truncated replies
+		{"+OK\n", nil, true},
+		{"\r\n", nil, true},
+		{"?1\r\n", nil, true},
+		{":x\r\n", nil, true},
+		{"$x\r\n", nil, true},
+		{"$5\r\nnode\r\n", nil, true},
+		{"$4\r\nnode12", nil, true},
+		{"*2\r\n:1\r\n", nil, true},
+		{"*x\r\n", nil, true},
+		{"", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := readReply(bufio.NewReader(strings.NewReader(tt.in)))
+		if (err != nil) != tt.err {
+			t.Errorf("readReply(%q) error %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if !tt.err && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("readReply(%q) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRedisError(t *testing.T) {
+	_, err := readReply(bufio.NewReader(strings.NewReader("-NOSCRIPT no script\r\n")))
+	if _, ok := err.(redisError); !ok || err.Error() != "redis: NOSCRIPT no script" {
+		t.Errorf("error reply returned %#v", err)
+	}
+}
+
+func TestRedisCall(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	r := &redisLeases{conn: client, rd: bufio.NewReader(client)}
+
+	want := "*3\r\n$3\r\nGET\r\n$19\r\nws-vpn:lease:10.1.1\r\n$0\r\n\r\n"
+	go func() {
+		buf := make([]byte, len(want))
+		n, _ := server.Read(buf)
+		if string(buf[:n]) != want {
+			t.Errorf("command sent as %q, want %q", buf[:n], want)
+		}
+		server.Write([]byte("$2\r\nok\r\n"))
+	}()
+	reply, err := r.call("GET", redisPrefix+"10.1.1", "")
+	if err != nil || reply != "ok" {
+		t.Errorf("call = %#v, %v", reply, err)
+	}
+}
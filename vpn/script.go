@@ -0,0 +1,81 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// default time a hook script may run
+const scriptWait = 10 * time.Second
+
+// run hook script with VPN_* variables from env added to the environment,
+// the output is logged. env is only called when a script is set. Fails when
+// the script exits with an error or doesn't finish within timeout.
+func runScript(kind, path string, env func() []string, timeout time.Duration) error {
+	if path == "" {
+		return nil
+	}
+	if timeout <= 0 {
+		timeout = scriptWait
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, path)
+	// children of a killed script may still hold the output open
+	cmd.WaitDelay = time.Second
+	cmd.Env = append(os.Environ(), "VPN_SCRIPT="+kind)
+	cmd.Env = append(cmd.Env, env()...)
+	logger.Info("Running", kind, "script", path)
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		logger.Info(kind+":", strings.TrimSpace(string(out)))
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s script %s timed out after %s", kind, path, timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%s script %s: %v", kind, path, err)
+	}
+	return nil
+}
+
+// environment describing the tunnel interface, iface is nil before it
+// was created
+func ifaceEnv(iface device, ip, peer net.IP, subnet *net.IPNet, mtu int) []string {
+	env := []string{
+		"VPN_IP=" + ip.String(),
+		"VPN_SUBNET=" + subnet.String(),
+		"VPN_MTU=" + strconv.Itoa(mtu),
+	}
+	if iface != nil {
+		env = append(env, "VPN_IFACE="+iface.Name())
+	}
+	if peer != nil {
+		env = append(env, "VPN_PEER="+peer.String())
+	}
+	return env
+}
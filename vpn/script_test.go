@@ -0,0 +1,146 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/zreigz/ws-vpn/vpn/utils"
+)
+
+// tun interface stand-in, only the name is used
+type namedDevice struct {
+	io.ReadWriteCloser
+	name string
+}
+
+func (d namedDevice) Name() string { return d.name }
+
+// environment a script wrote to the file, one variable per line
+func readEnv(t *testing.T, file string) map[string]string {
+	t.Helper()
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := make(map[string]string)
+	for _, line := range strings.Split(string(b), "\n") {
+		if i := strings.IndexByte(line, '='); i > 0 {
+			env[line[:i]] = line[i+1:]
+		}
+	}
+	return env
+}
+
+func TestRunScriptTimeout(t *testing.T) {
+	script := testScript(t, "sleep 5")
+	start := time.Now()
+	err := runScript("up", script, func() []string { return nil }, 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("runScript = %v, want timeout", err)
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("script killed after %s", d)
+	}
+}
+
+func TestRunScriptExitCode(t *testing.T) {
+	if err := runScript("up", testScript(t, "exit 1"), func() []string { return nil }, 0); err == nil {
+		t.Error("failing script succeeded")
+	}
+	if err := runScript("up", testScript(t, "exit 0"), func() []string { return nil }, 0); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunScriptNoPath(t *testing.T) {
+	env := func() []string {
+		t.Error("environment built without a script")
+		return nil
+	}
+	if err := runScript("down", "", env, 0); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunScriptEnv(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "env")
+	_, subnet, _ := net.ParseCIDR("10.1.1.0/24")
+	env := func() []string {
+		return ifaceEnv(namedDevice{name: "tun7"}, net.ParseIP("10.1.1.1"), net.ParseIP("10.1.1.2"), subnet, 1400)
+	}
+	if err := runScript("up", testScript(t, "env > "+out), env, 0); err != nil {
+		t.Fatal(err)
+	}
+	got := readEnv(t, out)
+	want := map[string]string{
+		"VPN_SCRIPT": "up",
+		"VPN_IFACE":  "tun7",
+		"VPN_IP":     "10.1.1.1",
+		"VPN_PEER":   "10.1.1.2",
+		"VPN_SUBNET": "10.1.1.0/24",
+		"VPN_MTU":    "1400",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+func TestClientConnectEnv(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "env")
+	_, url := testServer(t, ServerConfig{ClientConnect: testScript(t, "env > "+out)})
+	_, reply := testDial(t, url, &Handshake{Name: "alice"})
+	if reply.ConnectionState != STATE_CONNECT {
+		t.Fatalf("reply %+v", reply)
+	}
+	got := readEnv(t, out)
+	want := map[string]string{
+		"VPN_SCRIPT":      "client-connect",
+		"VPN_CLIENT_IP":   "10.1.1.3",
+		"VPN_CLIENT_NAME": "alice",
+		"VPN_IP":          "10.1.1.1",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+	if _, ok := got["VPN_IFACE"]; ok {
+		t.Error("VPN_IFACE set without an interface")
+	}
+}
+
+func TestClientConnectRejects(t *testing.T) {
+	srv, url := testServer(t, ServerConfig{ClientConnect: testScript(t, "exit 1")})
+	_, reply := testDial(t, url, &Handshake{Name: "alice"})
+	if reply.ConnectionState != STATE_ERROR || reply.Error != errRejectedByScript.Error() {
+		t.Errorf("reply %+v, want %v", reply, errRejectedByScript)
+	}
+	if _, ok := srv.client("10.1.1.3"); ok {
+		t.Error("rejected client registered")
+	}
+	waitReleased(t, srv, net.ParseIP("10.1.1.3"))
+}
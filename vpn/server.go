@@ -24,20 +24,31 @@ import (
 	"github.com/songgao/water"
 	. "github.com/zreigz/ws-vpn/vpn/utils"
 
+	"context"
 	"fmt"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"golang.org/x/net/ipv4"
 )
 
-type VpnServer struct {
+type Server struct {
 	// config
 	cfg        ServerConfig
+	// callbacks and listener of an embedded server
+	opts       ServerOptions
 	// interface
 	iface      *water.Interface
+	// interface queues, the first one is iface
+	queues     []*water.Interface
 	// subnet
 	ipnet      *net.IPNet
 	// IP Pool
@@ -46,6 +57,11 @@ type VpnServer struct {
 
 	// Registered clients
 	clients    map[string]*connection
+	// Registered clients by session token
+	sessions   map[string]*connection
+	clientsMu  sync.RWMutex
+	// last connection id
+	maxId      int32
 
 	// Register requests
 	register   chan *connection
@@ -57,169 +73,856 @@ type VpnServer struct {
 
 	inData     chan *Data
 
-	toIface    chan []byte
+	// packets for every queue
+	toIface    []chan *Data
+
+	// handler for requests which are not tunnel connections
+	decoy      http.Handler
+	httpServer *http.Server
+
+	// proxies allowed to report the real client address
+	trusted    trustedProxies
+
+	// monthly transfer counters
+	quotas     *quotaStore
+
+	// packet filter
+	acl        *acl
+
+	// masquerading rules, nil when disabled
+	nat        *nat
+
+	// static key for payload encryption, nil when disabled
+	key        *keyPair
+
+	// accepts websockets, negotiates compression when enabled
+	upgrader   websocket.Upgrader
+	compress   bool
+
+	// resolver for client names, nil when disabled
+	dns        *dnsServer
+
+	// address pool shared with other nodes, nil when not clustered
+	cluster    *cluster
+
+	// interface mtu and peer address
+	mtu        int
+	peer       net.IP
+
+	// ping period and timeout of client websockets
+	ping       time.Duration
+	pingWait   time.Duration
+
+	// closed when the server stops
+	done       chan struct{}
+	closeOnce  sync.Once
+	// error which stopped the server
+	err        error
+	// first error of the cleanup
+	closeErr   error
+
+	// subscribers to client state transitions
+	hooks      []ConnectionHook
+	hooksMu    sync.RWMutex
+}
+
+// ServerOptions configures a server embedded in another program. The
+// callbacks are optional and must not block, callbacks for different
+// clients can run at the same time.
+type ServerOptions struct {
+	Config       ServerConfig
+	// serve on this listener instead of the configured address and port
+	Listener     net.Listener
+	// client got an address
+	OnConnect    func(ClientInfo)
+	// client session ended
+	OnDisconnect func(ClientInfo)
+}
+
+// ConnectionHook is called after every state transition of a client
+// session with the error which caused it
+type ConnectionHook func(info ClientInfo, from, to State, err error)
+
+// ClientInfo describes a client session for the server callbacks
+type ClientInfo struct {
+	// name sent in the handshake, empty for anonymous clients
+	Identity   string
+	// address assigned in the tunnel
+	Address    net.IP
+	// real client address, see trustedProxy
+	RemoteAddr string
 }
 
+// NewServer runs a server with the config until SIGINT or SIGTERM,
+// SIGUSR1 logs packet filter counters.
 func NewServer(cfg ServerConfig) error {
-	var err error
+	srv, err := NewServerWithOptions(ServerOptions{Config: cfg})
+	if err != nil {
+		return err
+	}
+	if err := srv.Start(context.Background()); err != nil {
+		return err
+	}
 
-	if cfg.MTU != 0 {
-		MTU = cfg.MTU
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
+	defer signal.Stop(c)
+	for {
+		select {
+		case sig := <-c:
+			if sig == syscall.SIGUSR1 {
+				srv.acl.dump()
+				continue
+			}
+			logger.Debug("clean up")
+			return srv.Close()
+		case <-srv.Done():
+			return srv.Err()
+		}
 	}
+}
+
+// NewServerWithOptions checks the configuration and returns a server
+// which is not running yet, see Start.
+func NewServerWithOptions(opts ServerOptions) (*Server, error) {
+	var err error
+	cfg := opts.Config
 
-	vpnServer := new(VpnServer)
+	vpnServer := new(Server)
 
 	vpnServer.cfg = cfg
+	vpnServer.opts = opts
 
 	vpnServer.ippool = new(VpnIpPool)
 
-	iface, err := newTun("")
+	vpnServer.decoy, err = newDecoy(cfg)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	vpnServer.iface = iface
+
+	vpnServer.trusted, err = parseTrustedProxies(cfg.TrustedProxy, cfg.ProxyHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	vpnServer.quotas, err = newQuotaStore(cfg.QuotaFile)
+	if err != nil {
+		return nil, err
+	}
+
+	vpnServer.acl, err = newAcl(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkIdentityKeys(cfg); err != nil {
+		return nil, err
+	}
+
+	vpnServer.ping, vpnServer.pingWait, err = keepaliveConfig(cfg.PingInterval, cfg.PingTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	vpnServer.compress, err = compressionEnabled(cfg.Compression)
+	if err != nil {
+		return nil, err
+	}
+	vpnServer.upgrader = upgrader
+	vpnServer.upgrader.EnableCompression = vpnServer.compress
+
+	if cfg.PrivateKey != "" {
+		private, err := decodeKey(cfg.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		if vpnServer.key, err = newKeyPair(private); err != nil {
+			return nil, err
+		}
+	}
+
 	ip, subnet, err := net.ParseCIDR(cfg.VpnAddr)
-	err = setTunIP(iface, ip, subnet)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	vpnServer.ipnet = &net.IPNet{ip, subnet.Mask}
 	vpnServer.ippool.subnet = subnet
 
-	go vpnServer.cleanUp()
-
-	go vpnServer.run()
+	if cfg.Cluster != "" {
+		vpnServer.cluster, err = newCluster(cfg.Cluster, cfg.ClusterNode, vpnServer.ippool)
+		if err != nil {
+			return nil, err
+		}
+		vpnServer.cluster.lost = vpnServer.leaseLost
+	}
 
 	vpnServer.register = make(chan *connection)
 	vpnServer.unregister = make(chan *connection)
 	vpnServer.clients = make(map[string]*connection)
+	vpnServer.sessions = make(map[string]*connection)
 	vpnServer.inData = make(chan *Data, 100)
-	vpnServer.toIface = make(chan []byte, 100)
+	vpnServer.done = make(chan struct{})
 
-	vpnServer.handleInterface()
+	return vpnServer, nil
+}
 
-	http.HandleFunc("/ws", vpnServer.serveWs)
+// Start creates the tun interface and serves clients until the context is
+// canceled or Close is called.
+func (srv *Server) Start(ctx context.Context) error {
+	var err error
+	cfg := srv.cfg
 
-	adr := fmt.Sprintf(":%d", vpnServer.cfg.Port)
-	err = http.ListenAndServe(adr, nil)
+	srv.mtu = cfg.MTU
+	if srv.mtu == 0 {
+		srv.mtu = DEFAULT_MTU
+	}
+	srv.queues, err = newTunQueues("", cfg.Queues, srv.mtu)
 	if err != nil {
-		logger.Panic("ListenAndServe: " + err.Error())
+		return err
+	}
+	srv.iface = srv.queues[0]
+	if srv.peer, err = setTunIP(srv.iface, srv.ipnet.IP, srv.ippool.subnet); err != nil {
+		srv.closeQueues()
+		return err
+	}
+
+	if cfg.Masquerade {
+		srv.nat, err = setupNat(srv.iface.Name(), srv.ippool.subnet.String(), cfg.NatInterface)
+		if err != nil {
+			srv.closeQueues()
+			return err
+		}
 	}
 
+	abort := func(err error) error {
+		if srv.dns != nil {
+			srv.dns.close()
+		}
+		if srv.cluster != nil {
+			srv.cluster.close()
+		}
+		if srv.nat != nil {
+			srv.nat.teardown()
+		}
+		srv.closeQueues()
+		return err
+	}
+
+	if cfg.Dns {
+		if cfg.DnsDomain != "" {
+			if err := parseDomain(cfg.DnsDomain); err != nil {
+				return abort(err)
+			}
+		}
+		srv.dns = newDnsServer(srv, cfg.DnsDomain, cfg.DnsUpstream)
+		if err := srv.dns.start(srv.ipnet.IP); err != nil {
+			srv.dns = nil
+			return abort(err)
+		}
+	}
+
+	if srv.cluster != nil {
+		// learn the addresses taken by other nodes before serving clients
+		if err := srv.cluster.refresh(); err != nil {
+			return abort(err)
+		}
+	}
+
+	if err := runScript("up", cfg.Up, srv.scriptEnv, srv.scriptWait()); err != nil {
+		return abort(err)
+	}
+
+	listener := srv.opts.Listener
+	if listener == nil {
+		adr := fmt.Sprintf("%s:%d", cfg.ListenAddr, cfg.Port)
+		listener, err = net.Listen("tcp", adr)
+		if err != nil {
+			runScript("down", cfg.Down, srv.scriptEnv, srv.scriptWait())
+			return abort(err)
+		}
+	}
+
+	srv.toIface = make([]chan *Data, len(srv.queues))
+	for i := range srv.toIface {
+		srv.toIface[i] = make(chan *Data, 100)
+	}
+
+	go srv.run()
+
+	go srv.quotas.run(srv.done)
+
+	if srv.cluster != nil {
+		go srv.cluster.run(srv.done)
+	}
+
+	srv.handleInterface()
+
+	path := cfg.Path
+	if path == "" {
+		path = WS_PATH
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, srv.serveWs)
+	mux.Handle("/", srv.decoy)
+	srv.httpServer = &http.Server{Handler: mux}
+
+	go func() {
+		err := srv.httpServer.Serve(listener)
+		if err != http.ErrServerClosed {
+			logger.Error("Serve:", err)
+			srv.stop(err)
+		}
+	}()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			srv.Close()
+		case <-srv.done:
+		}
+	}()
+
 	return nil
+}
 
+// Subscribe adds a hook called on state transitions of all client sessions.
+// Hooks run on connection goroutines and must not block. Transitions of one
+// session are delivered one at a time and in order, hooks for different
+// sessions can run at the same time.
+func (srv *Server) Subscribe(hook ConnectionHook) {
+	srv.hooksMu.Lock()
+	defer srv.hooksMu.Unlock()
+	srv.hooks = append(srv.hooks, hook)
 }
 
-func (srv *VpnServer) serveWs(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		http.Error(w, "Method not allowed", 405)
+func (srv *Server) stateChanged(c *connection, from, to State, err error) {
+	srv.hooksMu.RLock()
+	hooks := srv.hooks
+	srv.hooksMu.RUnlock()
+	if len(hooks) == 0 {
 		return
 	}
+	info := c.info()
+	for _, hook := range hooks {
+		hook(info, from, to, err)
+	}
+}
 
-	ws, err := upgrader.Upgrade(w, r, nil)
+// Done returns a channel closed when the server stops
+func (srv *Server) Done() <-chan struct{} {
+	return srv.done
+}
+
+// Err returns the error which stopped the server, nil while it runs or
+// after Close
+func (srv *Server) Err() error {
+	if !srv.closed() {
+		return nil
+	}
+	return srv.err
+}
+
+// Close disconnects all clients and removes the interface and NAT rules.
+// Clients get a going away close message, so they can reconnect elsewhere,
+// once their queued packets are sent or the drain timeout passes. Returns
+// the first error of the cleanup.
+func (srv *Server) Close() error {
+	srv.stop(nil)
+	return srv.closeErr
+}
+
+func (srv *Server) stop(err error) {
+	srv.closeOnce.Do(func() {
+		srv.err = err
+
+		// no new clients
+		if srv.httpServer != nil {
+			srv.httpServer.Close()
+		}
+
+		timeout := drainWait
+		if srv.cfg.DrainTimeout > 0 {
+			timeout = time.Duration(srv.cfg.DrainTimeout) * time.Second
+		}
+		deadline := time.Now().Add(timeout)
+
+		srv.clientsMu.RLock()
+		clients := make([]*connection, 0, len(srv.clients))
+		for _, c := range srv.clients {
+			clients = append(clients, c)
+		}
+		srv.clientsMu.RUnlock()
+
+		var wg sync.WaitGroup
+		for _, c := range clients {
+			wg.Add(1)
+			go func(c *connection) {
+				defer wg.Done()
+				c.drain(deadline, websocket.CloseGoingAway, shutdownReason)
+			}(c)
+		}
+		wg.Wait()
+		for _, toIface := range srv.toIface {
+			for len(toIface) > 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+
+		close(srv.done)
+
+		// sessions not unregistered yet
+		srv.clientsMu.Lock()
+		removed := make([]*connection, 0, len(srv.clients))
+		for key, c := range srv.clients {
+			delete(srv.clients, key)
+			delete(srv.sessions, c.session)
+			c.close()
+			removed = append(removed, c)
+		}
+		srv.clientsMu.Unlock()
+		for _, c := range removed {
+			c.flushQuota()
+			srv.disconnected(c)
+			srv.ippool.relase(c.ipAddress.IP)
+		}
+		for _, toIface := range srv.toIface {
+			for len(toIface) > 0 {
+				select {
+				case d := <-toIface:
+					d.release()
+				default:
+				}
+			}
+		}
+
+		srv.acl.dump()
+		if err := srv.quotas.save(); err != nil {
+			logger.Error("Saving quota counters:", err)
+			srv.closeErr = err
+		}
+		if srv.nat != nil {
+			if err := srv.nat.teardown(); err != nil && srv.closeErr == nil {
+				srv.closeErr = err
+			}
+		}
+		if srv.dns != nil {
+			srv.dns.close()
+		}
+		if srv.cluster != nil {
+			if err := srv.cluster.close(); err != nil && srv.closeErr == nil {
+				srv.closeErr = err
+			}
+		}
+		// down only follows up, a server closed before Start has no interface
+		if srv.iface != nil {
+			if err := runScript("down", srv.cfg.Down, srv.scriptEnv, srv.scriptWait()); err != nil {
+				logger.Error(err)
+				if srv.closeErr == nil {
+					srv.closeErr = err
+				}
+			}
+		}
+		// the kernel removes address and routes with the interface
+		srv.closeQueues()
+		logger.Info("Server stopped")
+	})
+}
+
+const shutdownReason = "Server shutting down"
+
+// environment of hook scripts
+func (srv *Server) scriptEnv() []string {
+	var iface device
+	if srv.iface != nil {
+		iface = srv.iface
+	}
+	return ifaceEnv(iface, srv.ipnet.IP, srv.peer, srv.ippool.subnet, srv.mtu)
+}
+
+func (srv *Server) scriptWait() time.Duration {
+	return time.Duration(srv.cfg.ScriptTimeout) * time.Second
+}
+
+// client session ended, notify callback and script
+func (srv *Server) disconnected(c *connection) {
+	if srv.opts.OnDisconnect != nil {
+		srv.opts.OnDisconnect(c.info())
+	}
+	srv.scriptDisconnect(c)
+}
+
+// run client-disconnect script, pairs every successful client-connect
+func (srv *Server) scriptDisconnect(c *connection) {
+	if err := runScript("client-disconnect", srv.cfg.ClientDisconnect, c.scriptEnv, srv.scriptWait()); err != nil {
+		logger.Warning(err)
+	}
+}
+
+func (srv *Server) closeQueues() {
+	for _, queue := range srv.queues {
+		queue.Close()
+	}
+}
+
+// return true once the server stopped
+func (srv *Server) closed() bool {
+	select {
+	case <-srv.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// newDecoy returns the handler answering everything except the tunnel
+// endpoint, so the port looks like an ordinary website
+func newDecoy(cfg ServerConfig) (http.Handler, error) {
+	if cfg.WebRoot != "" {
+		return http.FileServer(http.Dir(cfg.WebRoot)), nil
+	}
+	if cfg.Upstream != "" {
+		u, err := url.Parse(cfg.Upstream)
+		if err != nil {
+			return nil, err
+		}
+		return httputil.NewSingleHostReverseProxy(u), nil
+	}
+	return http.NotFoundHandler(), nil
+}
+
+func (srv *Server) serveWs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" || !websocket.IsWebSocketUpgrade(r) {
+		srv.decoy.ServeHTTP(w, r)
+		return
+	}
+
+	remoteAddr := srv.trusted.clientAddr(r)
+
+	ws, err := srv.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		logger.Error(err)
+		logger.Error(remoteAddr, err)
 		return
 	}
 
-	NewConnection(ws, srv)
+	NewConnection(ws, srv, remoteAddr)
 
 }
 
-func (srv *VpnServer) run() {
+func (srv *Server) run() {
 	for {
 		select {
 		case c := <-srv.register:
-			logger.Info("Connection registered:", c.ipAddress.IP.String())
+			logger.Info("Connection registered:", c.ipAddress.IP.String(), "from", c.remoteAddr)
+			srv.clientsMu.Lock()
 			srv.clients[c.ipAddress.IP.String()] = c
+			srv.sessions[c.session] = c
+			srv.clientsMu.Unlock()
+			if srv.opts.OnConnect != nil {
+				srv.opts.OnConnect(c.info())
+			}
 			break
 
 		case c := <-srv.unregister:
+			if c.ipAddress == nil {
+				// rejected before an address was assigned
+				break
+			}
 			clientIP := c.ipAddress.IP.String()
+			srv.clientsMu.Lock()
 			_, ok := srv.clients[clientIP]
 			if ok {
 				delete(srv.clients, clientIP)
-				close(c.data)
-				if c.ipAddress != nil {
-					srv.ippool.relase(c.ipAddress.IP)
-				}
-				logger.Info("Connection removed:", c.ipAddress.IP)
+				delete(srv.sessions, c.session)
+			}
+			srv.clientsMu.Unlock()
+			if ok {
+				c.flushQuota()
+				logger.Info("Connection removed:", c.ipAddress.IP, "from", c.remoteAddr)
 				logger.Info("Number active clients:", len(srv.clients))
+				go func(c *connection) {
+					// the address is handed out again only after
+					// client-disconnect cleaned up after it
+					srv.disconnected(c)
+					srv.ippool.relase(c.ipAddress.IP)
+				}(c)
 			}
 			break
 
+		case <-srv.done:
+			return
+
 		}
 	}
 }
 
-func (srv *VpnServer) handleInterface() {
-	// network packet to interface
-	go func() {
-		for {
-			hp := <-srv.toIface
-			logger.Debug("Write to interface")
-			_, err := srv.iface.Write(hp)
-			if err != nil {
-				logger.Error(err.Error())
-				return
-			}
-
-		}
-	}()
+func (srv *Server) handleInterface() {
+	for i, queue := range srv.queues {
+		queue, toIface := queue, srv.toIface[i]
+		// network packet to interface
+		go func() {
+			for {
+				var hp *Data
+				select {
+				case hp = <-toIface:
+				case <-srv.done:
+					return
+				}
+				logger.Debug("Write to interface")
+				_, err := queue.Write(hp.Payload)
+				hp.release()
+				if err != nil {
+					if !srv.closed() {
+						logger.Error(err.Error())
+					}
+					return
+				}
 
-	go func() {
-		packet := make([]byte, IFACE_BUFSIZE)
-		for {
-			plen, err := srv.iface.Read(packet)
-			if err != nil {
-				logger.Error(err)
-				break
 			}
-			header, _ := ipv4.ParseHeader(packet[:plen])
-			logger.Debug("Try sending: ", header)
-			clientIP := header.Dst.String()
-			client, ok := srv.clients[clientIP]
-			if ok {
-				if !srv.cfg.Interconnection {
-					if srv.isConnectionBetweenClients(header) {
+		}()
+
+		go func() {
+			for {
+				d := newPacket()
+				plen, err := queue.Read(d.buf)
+				if err != nil {
+					if !srv.closed() {
+						logger.Error(err)
+					}
+					d.release()
+					break
+				}
+				d.Payload = d.buf[:plen]
+				header, err := ipv4.ParseHeader(d.Payload)
+				if err != nil {
+					logger.Debug("Drop packet: ", err)
+					d.release()
+					continue
+				}
+				logger.Debug("Try sending: ", header)
+				clientIP := header.Dst.String()
+				client, ok := srv.client(clientIP)
+				if ok {
+					if srv.isConnectionBetweenClients(header) && !srv.canReach(header.Src, client) {
 						logger.Info("Drop connection betwenn ", header.Src, header.Dst)
+						d.release()
+						continue
+					}
+
+					if !srv.acl.allowed(d.Payload, client, DIR_DOWN) {
+						d.release()
 						continue
 					}
-				}
 
-				logger.Debug("Sending to client: ", client.ipAddress)
-				client.data <- &Data{
-					ConnectionState: STATE_CONNECTED,
-					Payload:         packet[:plen],
+					if !client.limitDown.allow(plen) {
+						logger.Debug("Rate limit, drop packet to ", client.ipAddress)
+						d.release()
+						continue
+					}
+					client.account(plen)
+
+					logger.Debug("Sending to client: ", client.ipAddress)
+					if !client.send(d) {
+						logger.Debug("Queue full, drop packet to ", client.ipAddress)
+					}
+
+				} else {
+					logger.Warning("Client not found ", clientIP)
+					d.release()
 				}
 
-			} else {
-				logger.Warning("Client not found ", clientIP)
 			}
+		}()
+	}
+}
 
+// queue packet for the interface, packets of one flow use the same queue
+func (srv *Server) sendIface(d *Data) {
+	select {
+	case srv.toIface[flowHash(d.Payload)%uint32(len(srv.toIface))] <- d:
+	case <-srv.done:
+		d.release()
+	}
+}
+
+// return limits for the identity, identity settings override server defaults
+func (srv *Server) limits(identity string) IdentityConfig {
+	limits := IdentityConfig{
+		RateUp:      srv.cfg.RateUp,
+		RateDown:    srv.cfg.RateDown,
+		Quota:       srv.cfg.Quota,
+		QuotaAction: srv.cfg.QuotaAction,
+		QuotaRate:   srv.cfg.QuotaRate,
+	}
+	if limits.QuotaRate == 0 {
+		limits.QuotaRate = DEFAULT_QUOTA_RATE
+	}
+	id, ok := srv.cfg.Identity[identity]
+	if identity == "" || !ok {
+		return limits
+	}
+	if id.RateUp != 0 {
+		limits.RateUp = id.RateUp
+	}
+	if id.RateDown != 0 {
+		limits.RateDown = id.RateDown
+	}
+	if id.Quota != 0 {
+		limits.Quota = id.Quota
+	}
+	if id.QuotaAction != "" {
+		limits.QuotaAction = id.QuotaAction
+	}
+	if id.QuotaRate != 0 {
+		limits.QuotaRate = id.QuotaRate
+	}
+	return limits
+}
+
+// check identity keys, they can't be used without a server key
+func checkIdentityKeys(cfg ServerConfig) error {
+	for name, id := range cfg.Identity {
+		if id.Key == "" {
+			if id.Group != "" {
+				logger.Warning("Identity", name, "has no key, its group is not used")
+			}
+			continue
 		}
-	}()
+		if cfg.PrivateKey == "" {
+			return fmt.Errorf("Identity %s has a key but privateKey is not set", name)
+		}
+		if _, err := decodeKey(id.Key); err != nil {
+			return fmt.Errorf("Identity %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// disconnect the client whose address lease this node lost, another node
+// may hand the address out
+func (srv *Server) leaseLost(ip net.IP, err error) {
+	if c, ok := srv.client(ip.String()); ok {
+		logger.Warning(c.remoteAddr, c.identity, err)
+		go c.reject(err)
+	}
 }
 
-func (srv *VpnServer) isConnectionBetweenClients(header *ipv4.Header) bool {
+// return registered client with the IP address
+func (srv *Server) client(ip string) (*connection, bool) {
+	srv.clientsMu.RLock()
+	defer srv.clientsMu.RUnlock()
+	c, ok := srv.clients[ip]
+	return c, ok
+}
 
-	if (header.Src.String() != header.Dst.String() && header.Src.String() != srv.ipnet.IP.String() && srv.ippool.subnet.Contains(header.Dst)) {
+// return address of the registered client with the name
+func (srv *Server) lookupName(name string) (net.IP, bool) {
+	if name == "" {
+		return nil, false
+	}
+	srv.clientsMu.RLock()
+	defer srv.clientsMu.RUnlock()
+	var found, authenticated []*connection
+	for _, c := range srv.clients {
+		if strings.EqualFold(c.identity, name) {
+			found = append(found, c)
+			if c.authenticated {
+				authenticated = append(authenticated, c)
+			}
+		}
+	}
+	// names are chosen by clients, a name taken by several of them resolves
+	// only to the one which proved an identity key
+	if len(authenticated) == 1 {
+		return authenticated[0].ipAddress.IP, true
+	}
+	if len(authenticated) == 0 && len(found) == 1 {
+		return found[0].ipAddress.IP, true
+	}
+	return nil, false
+}
+
+// return registered client with the session token
+func (srv *Server) session(token string) (*connection, bool) {
+	srv.clientsMu.RLock()
+	defer srv.clientsMu.RUnlock()
+	c, ok := srv.sessions[token]
+	return c, ok
+}
+
+// check interconnection policy between source address and client. Clients
+// of two groups can talk to each other when one of them lists the other
+// in reach, a group has to list itself to allow traffic between its clients.
+func (srv *Server) canReach(src net.IP, dst *connection) bool {
+	if srv.cfg.Interconnection {
 		return true
 	}
+	from, ok := srv.client(src.String())
+	if !ok {
+		return false
+	}
+	return srv.canReachClient(from, dst)
+}
+
+func (srv *Server) canReachClient(from, to *connection) bool {
+	if srv.cfg.Interconnection {
+		return true
+	}
+	if from.group == "" || to.group == "" {
+		return false
+	}
+	return srv.groupReaches(from.group, to.group) || srv.groupReaches(to.group, from.group)
+}
 
+func (srv *Server) groupReaches(from, to string) bool {
+	group, ok := srv.cfg.Group[from]
+	if !ok {
+		return false
+	}
+	for _, name := range group.Reach {
+		if name == to || name == "*" {
+			return true
+		}
+	}
 	return false
 }
 
-func (srv *VpnServer) cleanUp() {
+// forward packet from client directly to another connected client without
+// the round trip through the kernel. Returns false when the destination is
+// not a client and the packet has to go to the interface, otherwise the
+// packet record is consumed.
+func (srv *Server) switchPacket(from *connection, d *Data) bool {
+	p := d.Payload
+	info, ok := parsePacket(p)
+	if !ok || !srv.ippool.subnet.Contains(info.dst) || info.dst.Equal(srv.ipnet.IP) {
+		return false
+	}
+	to, ok := srv.client(info.dst.String())
+	if !ok {
+		return false
+	}
+	if to == from || !srv.canReachClient(from, to) {
+		logger.Debug("Drop connection between ", info.src, info.dst)
+		d.release()
+		return true
+	}
+	if !srv.acl.allowed(p, to, DIR_DOWN) || !to.limitDown.allow(len(p)) {
+		d.release()
+		return true
+	}
+	to.account(len(p))
+
+	if !to.send(d) {
+		logger.Debug("Queue full, drop packet to ", info.dst)
+	}
+	return true
+}
+
+func (srv *Server) isConnectionBetweenClients(header *ipv4.Header) bool {
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-	<-c
-	logger.Debug("clean up")
-	for key, client := range srv.clients {
-		client.ws.Close()
-		delete(srv.clients, key)
+	if (header.Src.String() != header.Dst.String() && header.Src.String() != srv.ipnet.IP.String() && srv.ippool.subnet.Contains(header.Dst)) {
+		return true
 	}
 
-	os.Exit(0)
+	return false
 }
@@ -0,0 +1,210 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	. "github.com/zreigz/ws-vpn/vpn/utils"
+)
+
+// server without tun interface serving websockets, returns its url
+func testServer(t *testing.T, cfg ServerConfig) (*Server, string) {
+	t.Helper()
+	srv := newTestServer(t, cfg)
+	return srv, serveTest(t, srv)
+}
+
+// server without tun interface, settings can be changed until it serves
+func newTestServer(t *testing.T, cfg ServerConfig) *Server {
+	t.Helper()
+	if cfg.VpnAddr == "" {
+		cfg.VpnAddr = "10.1.1.1/24"
+	}
+	srv, err := NewServerWithOptions(ServerOptions{Config: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+// register clients and serve websockets of the server, returns its url
+func serveTest(t *testing.T, srv *Server) string {
+	go srv.run()
+	hs := httptest.NewServer(http.HandlerFunc(srv.serveWs))
+	t.Cleanup(func() {
+		hs.Close()
+		srv.Close()
+	})
+	return "ws" + strings.TrimPrefix(hs.URL, "http")
+}
+
+// open a websocket, send the hello and return the reply of the server
+func testDial(t *testing.T, url string, hello *Handshake) (*websocket.Conn, *Data) {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	msg, err := json.Marshal(&Data{ConnectionState: STATE_CONNECT, Handshake: hello})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.WriteMessage(websocket.TextMessage, msg); err != nil {
+		t.Fatal(err)
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer ws.SetReadDeadline(time.Time{})
+	_, p, err := ws.ReadMessage()
+	if ce, ok := err.(*websocket.CloseError); ok {
+		// close frame overtook the error frame, it carries the same reason
+		return ws, &Data{ConnectionState: STATE_ERROR, Error: ce.Text}
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	reply := new(Data)
+	if err := json.Unmarshal(p, reply); err != nil {
+		t.Fatal(err)
+	}
+	return ws, reply
+}
+
+// executable shell script with the body in a temporary directory
+func testScript(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "script.sh")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// wait until the pool slot of the address is free again
+func waitReleased(t *testing.T, srv *Server, ip net.IP) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&srv.ippool.pool[ip.To4()[3]]) != ipFree {
+		if time.Now().After(deadline) {
+			t.Fatal(ip, "not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCanReachClient(t *testing.T) {
+	srv := &Server{cfg: ServerConfig{Group: map[string]*GroupConfig{
+		"devs":   {Reach: []string{"devs", "ops"}},
+		"admins": {Reach: []string{"*"}},
+	}}}
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{"devs", "devs", true},
+		{"devs", "ops", true},
+		// reach works in both directions
+		{"ops", "devs", true},
+		{"ops", "ops", false},
+		{"admins", "guests", true},
+		{"guests", "admins", true},
+		{"guests", "guests", false},
+		{"", "devs", false},
+		{"devs", "", false},
+	}
+	for _, tt := range tests {
+		from := &connection{group: tt.from}
+		to := &connection{group: tt.to}
+		if got := srv.canReachClient(from, to); got != tt.want {
+			t.Errorf("%q -> %q: got %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+
+	srv.cfg.Interconnection = true
+	if !srv.canReachClient(&connection{}, &connection{}) {
+		t.Error("interconnection doesn't let clients without groups talk")
+	}
+}
+
+func TestCloseWithoutStart(t *testing.T) {
+	srv, err := NewServerWithOptions(ServerOptions{Config: ServerConfig{
+		VpnAddr: "10.1.1.1/24",
+		Down:    "/bin/false",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Close(); err != nil {
+		t.Errorf("Close = %v", err)
+	}
+	select {
+	case <-srv.Done():
+	default:
+		t.Error("server not done after Close")
+	}
+}
+
+func TestReleaseAfterClientDisconnect(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "disconnected")
+	srv, url := testServer(t, ServerConfig{
+		ClientDisconnect: testScript(t, "sleep 0.2; touch "+marker),
+	})
+	ws, reply := testDial(t, url, &Handshake{Name: "alice"})
+	ip, _, err := net.ParseCIDR(string(reply.Payload))
+	if err != nil {
+		t.Fatalf("reply %+v: %v", reply, err)
+	}
+	ws.Close()
+
+	waitReleased(t, srv, ip)
+	if _, err := os.Stat(marker); err != nil {
+		t.Error("address released before client-disconnect finished:", err)
+	}
+}
+
+func TestDeadPeerTimeout(t *testing.T) {
+	srv := newTestServer(t, ServerConfig{})
+	srv.ping, srv.pingWait = 20*time.Millisecond, 100*time.Millisecond
+	url := serveTest(t, srv)
+
+	// the client never reads again, so it answers no pings
+	_, reply := testDial(t, url, &Handshake{Name: "alice"})
+	ip, _, err := net.ParseCIDR(string(reply.Payload))
+	if err != nil {
+		t.Fatalf("reply %+v: %v", reply, err)
+	}
+
+	waitReleased(t, srv, ip)
+	if _, ok := srv.client(ip.String()); ok {
+		t.Error("silent client still registered")
+	}
+	if _, ok := srv.session(reply.Handshake.Session); ok {
+		t.Error("session of the silent client still open")
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"fmt"
+	"sync"
+)
+
+// State of a client session. Clients go from connecting (dialing, on the
+// server waiting for the hello) to authenticating (handshake in progress)
+// to established. A client whose server went away is reconnecting and
+// starts over with connecting, closed is final.
+type State int
+
+const (
+	StateConnecting State = iota
+	StateAuthenticating
+	StateEstablished
+	StateReconnecting
+	StateClosed
+)
+
+var stateNames = []string{"connecting", "authenticating", "established", "reconnecting", "closed"}
+
+func (s State) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+	return stateNames[s]
+}
+
+// allowed transitions, every state can go to closed
+var transitions = map[State][]State{
+	StateConnecting:     {StateAuthenticating, StateReconnecting},
+	StateAuthenticating: {StateEstablished, StateReconnecting},
+	StateEstablished:    {StateReconnecting},
+	StateReconnecting:   {StateConnecting},
+}
+
+// StateHook is called after every transition with the error which caused
+// it. Hooks of a session are called one at a time in the order of the
+// transitions, they must not block or change the state.
+type StateHook func(from, to State, err error)
+
+type stateMachine struct {
+	mu    sync.Mutex
+	state State
+	hooks []StateHook
+	// held while hooks run, taken before mu is released so that hooks of
+	// the next transition wait for the previous ones
+	notify sync.Mutex
+}
+
+func newStateMachine(initial State) *stateMachine {
+	return &stateMachine{state: initial}
+}
+
+func (m *stateMachine) get() State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+func (m *stateMachine) subscribe(hook StateHook) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hooks = append(m.hooks, hook)
+}
+
+// move to the state and call hooks. Closing a closed session does nothing,
+// other transitions not in the table return an error.
+func (m *stateMachine) transition(to State, cause error) error {
+	m.mu.Lock()
+	from := m.state
+	if from == StateClosed && to == StateClosed {
+		m.mu.Unlock()
+		return nil
+	}
+	if !canTransition(from, to) {
+		m.mu.Unlock()
+		return fmt.Errorf("Invalid state transition %s -> %s", from, to)
+	}
+	m.state = to
+	hooks := m.hooks
+	m.notify.Lock()
+	defer m.notify.Unlock()
+	m.mu.Unlock()
+
+	logger.Debug("State", from, "->", to)
+	for _, hook := range hooks {
+		hook(from, to, cause)
+	}
+	return nil
+}
+
+func canTransition(from, to State) bool {
+	if to == StateClosed {
+		return true
+	}
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
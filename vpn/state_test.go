@@ -0,0 +1,144 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: Lukasz Zajaczkowski <zreigz@gmail.com>
+ *
+ */
+package vpn
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to State
+		want     bool
+	}{
+		{StateConnecting, StateAuthenticating, true},
+		{StateConnecting, StateReconnecting, true},
+		{StateConnecting, StateEstablished, false},
+		{StateAuthenticating, StateEstablished, true},
+		{StateAuthenticating, StateReconnecting, true},
+		{StateAuthenticating, StateConnecting, false},
+		{StateEstablished, StateReconnecting, true},
+		{StateEstablished, StateAuthenticating, false},
+		{StateReconnecting, StateConnecting, true},
+		{StateReconnecting, StateEstablished, false},
+		{StateEstablished, StateClosed, true},
+		{StateConnecting, StateClosed, true},
+		{StateClosed, StateConnecting, false},
+		{StateClosed, StateReconnecting, false},
+	}
+	for _, tt := range tests {
+		if got := canTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("canTransition(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestStateTransition(t *testing.T) {
+	m := newStateMachine(StateConnecting)
+	if err := m.transition(StateEstablished, nil); err == nil {
+		t.Error("connecting -> established accepted")
+	}
+	if m.get() != StateConnecting {
+		t.Errorf("invalid transition changed state to %s", m.get())
+	}
+	for _, to := range []State{StateAuthenticating, StateEstablished, StateReconnecting, StateConnecting, StateClosed} {
+		if err := m.transition(to, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.transition(StateClosed, nil); err != nil {
+		t.Errorf("closing a closed session: %v", err)
+	}
+	if err := m.transition(StateConnecting, nil); err == nil {
+		t.Error("closed session reopened")
+	}
+}
+
+func TestStateHooks(t *testing.T) {
+	type call struct {
+		from, to State
+		err      error
+	}
+	var calls []call
+	m := newStateMachine(StateConnecting)
+	m.subscribe(func(from, to State, err error) {
+		calls = append(calls, call{from, to, err})
+	})
+	cause := errors.New("gone")
+	m.transition(StateAuthenticating, nil)
+	m.transition(StateConnecting, nil)
+	m.transition(StateClosed, cause)
+	m.transition(StateClosed, nil)
+
+	want := []call{
+		{StateConnecting, StateAuthenticating, nil},
+		{StateAuthenticating, StateClosed, cause},
+	}
+	if len(calls) != len(want) {
+		t.Fatalf("hooks called %d times, want %d: %v", len(calls), len(want), calls)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Errorf("call %d = %v, want %v", i, calls[i], want[i])
+		}
+	}
+}
+
+func TestStateString(t *testing.T) {
+	if s := StateReconnecting.String(); s != "reconnecting" {
+		t.Errorf("String() = %q", s)
+	}
+	if s := State(9).String(); s != "State(9)" {
+		t.Errorf("String() of unknown state = %q", s)
+	}
+}
+
+func TestStateHooksInOrder(t *testing.T) {
+	m := newStateMachine(StateConnecting)
+	var running int32
+	var seen []State
+	m.subscribe(func(from, to State, err error) {
+		if atomic.AddInt32(&running, 1) != 1 {
+			t.Error("hooks of one session ran at the same time")
+		}
+		time.Sleep(time.Millisecond)
+		seen = append(seen, to)
+		atomic.AddInt32(&running, -1)
+	})
+	m.transition(StateAuthenticating, nil)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		m.transition(StateEstablished, nil)
+	}()
+	go func() {
+		defer wg.Done()
+		m.transition(StateClosed, nil)
+	}()
+	wg.Wait()
+
+	// established is refused once closed, so closed is always seen last
+	if len(seen) < 2 || seen[len(seen)-1] != StateClosed {
+		t.Errorf("hooks saw %v, closed has to be last", seen)
+	}
+}
@@ -30,6 +30,111 @@ type ServerConfig struct {
 	VpnAddr         string
 	MTU             int
 	Interconnection bool
+	// WebSocket endpoint path, defaults to /ws
+	Path            string
+	// static directory served for non-tunnel requests
+	WebRoot         string
+	// upstream web app proxied for non-tunnel requests
+	Upstream        string
+	// reverse proxies allowed to set the client address (IP or CIDR)
+	TrustedProxy    []string
+	// header the proxies set, X-Forwarded-For (default) or Forwarded
+	ProxyHeader     string
+	// default limits, kbit/s, 0 is unlimited
+	RateUp          int
+	RateDown        int
+	// default monthly transfer quota in MB, 0 is unlimited
+	Quota           int64
+	// disconnect or throttle
+	QuotaAction     string
+	// rate in kbit/s when throttled
+	QuotaRate       int
+	// file where transfer counters are kept across restarts
+	QuotaFile       string
+	// per identity settings, from [identity "name"] sections
+	Identity        map[string]*IdentityConfig
+	// allow or deny packets not matched by any rule
+	AclDefault      string
+	// packet filter, from [rule "name"] sections
+	Rule            map[string]*RuleConfig
+	// interconnection policy, from [group "name"] sections
+	Group           map[string]*GroupConfig
+	// install NAT rules and enable ip_forward while running
+	Masquerade      bool
+	// outgoing interface for masquerading, any when empty
+	NatInterface    string
+	// allow clients to coalesce packets into one frame
+	Batch           bool
+	// wait up to BatchDelay ms for more packets, 0 sends what is queued
+	BatchDelay      int
+	// number of tun queues, each with its own reader and writer
+	Queues          int
+	// websocket compression allowed, only deflate
+	Compression     []string
+	// static X25519 key for payload encryption, base64
+	PrivateKey      string
+	// reject clients not using payload encryption
+	RequireEncryption bool
+	// seconds to flush queued packets to clients on shutdown
+	DrainTimeout    int
+	// seconds between pings and without any message before a client is dropped
+	PingInterval    int
+	PingTimeout     int
+	// scripts run when the tunnel comes up or goes down and when a client
+	// connects or disconnects, a failing clientConnect rejects the client
+	Up              string
+	Down            string
+	ClientConnect   string
+	ClientDisconnect string
+	// seconds a script may run
+	ScriptTimeout   int
+	// resolve client names on the tunnel address and push it to clients
+	Dns             bool
+	// domain of client names, vpn when empty
+	DnsDomain       string
+	// resolvers for other names, the ones of the host when empty
+	DnsUpstream     []string
+	// lease table shared with other nodes, file:///path or redis://host:port
+	Cluster         string
+	// address of this node, other nodes route its clients to it
+	ClusterNode     string
+}
+
+// Identity Config, overrides server defaults for one client name
+type IdentityConfig struct {
+	RateUp      int
+	RateDown    int
+	Quota       int64
+	QuotaAction string
+	QuotaRate   int
+	Group       string
+	// public key of the client, reserves the name for its holder
+	Key         string
+}
+
+// Group Config, lists groups whose clients can talk to clients of this group
+type GroupConfig struct {
+	Reach []string
+}
+
+// Rule Config, single packet filter rule
+type RuleConfig struct {
+	// rules are evaluated from the lowest priority
+	Priority  int
+	// allow, deny or log
+	Action    string
+	// source and destination CIDRs, any when empty
+	Src       []string
+	Dst       []string
+	// tcp, udp, icmp or protocol number, any when empty
+	Proto     string
+	// destination port or range, e.g. 22 or 8000-8080
+	Port      string
+	// match only clients with this identity or group
+	Identity  string
+	Group     string
+	// up (from client), down (to client) or both when empty
+	Direction string
 }
 
 // Client Config
@@ -38,14 +143,56 @@ type ClientConfig struct {
 	Port            int
 	MTU             int
 	RedirectGateway bool
+	// WebSocket endpoint path, defaults to /ws
+	Path            string
+	// client identity sent to the server
+	Name            string
+	// use userspace TCP/IP stack instead of a tun device, doesn't need root
+	Userspace       bool
+	// local SOCKS5 and HTTP proxy addresses in userspace mode
+	Socks           string
+	HttpProxy       string
+	// local port forwards "127.0.0.1:5432 -> 10.1.1.1:5432", implies userspace
+	Forward         []string
+	// coalesce packets into one frame when the server supports it
+	Batch           bool
+	// wait up to BatchDelay ms for more packets, 0 sends what is queued
+	BatchDelay      int
+	// number of parallel websockets carrying the session
+	Connections     int
+	// websocket compression offered to the server, only deflate
+	Compression     []string
+	// pinned static key of the server, enables payload encryption
+	ServerKey       string
+	// static key proving the client name, needs ServerKey
+	PrivateKey      string
+	// seconds between pings and without any message before disconnecting
+	PingInterval    int
+	PingTimeout     int
+	// scripts run when the tunnel comes up or goes down
+	Up              string
+	Down            string
+	// seconds a script may run
+	ScriptTimeout   int
+	// block traffic outside the tunnel until disconnected explicitly
+	KillSwitch      bool
+	// resolvers used while connected, one per line
+	Dns             []string
+	// only names in these domains use the tunnel resolvers (split DNS)
+	DnsDomain       []string
+	// more servers "ip:port priority", lower priority is preferred
+	Endpoint        []string
 }
 
 type VpnConfig struct {
 	Default struct {
 			Mode string
 		}
-	Server  ServerConfig
-	Client  ClientConfig
+	Server   ServerConfig
+	Client   ClientConfig
+	Identity map[string]*IdentityConfig
+	Rule     map[string]*RuleConfig
+	Group    map[string]*GroupConfig
 }
 
 func ParseConfig(filename string) (interface{}, error) {
@@ -56,6 +203,9 @@ func ParseConfig(filename string) (interface{}, error) {
 	}
 	switch cfg.Default.Mode {
 	case "server":
+		cfg.Server.Identity = cfg.Identity
+		cfg.Server.Rule = cfg.Rule
+		cfg.Server.Group = cfg.Group
 		return cfg.Server, nil
 	case "client":
 		return cfg.Client, nil